@@ -0,0 +1,73 @@
+package common
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// ErrAuthenticationFailed Returned when the server rejects a frame because
+// of its HMAC or its nonce
+var ErrAuthenticationFailed = errors.New("authentication failed")
+
+// LoadSecret Returns the secret shared with the server, taken from secret
+// or, if it is empty, from the content of the file at path. Returns nil if
+// both are empty
+func LoadSecret(secret string, path string) ([]byte, error) {
+	if secret != "" {
+		return []byte(secret), nil
+	}
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read secret file %v", path)
+	}
+	secret = strings.TrimSpace(string(data))
+	if secret == "" {
+		return nil, errors.Errorf("secret file %v is empty", path)
+	}
+	return []byte(secret), nil
+}
+
+// nextNonce Returns a nonce greater than every nonce returned before. It
+// follows the clock so that it keeps growing after the client restarts
+func (c *Client) nextNonce() uint64 {
+	nonce := uint64(time.Now().UnixNano())
+	if nonce <= c.nonce {
+		nonce = c.nonce + 1
+	}
+	c.nonce = nonce
+	return nonce
+}
+
+// seal Wraps the frame with the HMAC of the agency and a fresh nonce if an
+// authentication secret is configured
+func (c *Client) seal(f protocol.Frame) (protocol.Frame, error) {
+	if c.config.AuthSecret == nil {
+		return f, nil
+	}
+	agency, err := c.agency()
+	if err != nil {
+		return protocol.Frame{}, err
+	}
+	return protocol.SealFrame(c.config.AuthSecret, agency, c.nextNonce(), f), nil
+}
+
+// checkAuthentication Turns the rejection of a sealed frame into
+// ErrAuthenticationFailed
+func (c *Client) checkAuthentication(response protocol.Frame) error {
+	if c.config.AuthSecret == nil || response.Type != protocol.MsgAck {
+		return nil
+	}
+	ack, err := protocol.DecodeAck(response)
+	if err == nil && ack.Code == protocol.AckAuthenticationFailed {
+		return ErrAuthenticationFailed
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package common
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff Computes the time to wait before each retry. The wait starts at
+// initial and doubles on every attempt until it reaches max. A random
+// jitter of up to half the wait is subtracted so clients that failed at
+// the same time do not retry at the same time
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	current time.Duration
+	random  *rand.Rand
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	if initial <= 0 {
+		initial = 100 * time.Millisecond
+	}
+	if max < initial {
+		max = initial
+	}
+	return &backoff{
+		initial: initial,
+		max:     max,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next Returns the time to wait before the next attempt
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.initial
+	} else if b.current *= 2; b.current > b.max {
+		b.current = b.max
+	}
+	half := b.current / 2
+	return b.current - time.Duration(b.random.Int63n(int64(half)+1))
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// DefaultBatchMaxBytes Default size budget of a batch frame
+const DefaultBatchMaxBytes = 8 * 1024
+
+// ErrBetTooLarge Returned when a single bet does not fit in an empty batch
+var ErrBetTooLarge = errors.New("bet does not fit in a batch frame")
+
+// BetSource Provides bets one at a time. io.EOF is returned once every
+// bet has been provided
+type BetSource interface {
+	Next() (lottery.Bet, error)
+}
+
+// Batch Group of bets sent to the server in a single frame
+type Batch struct {
+	Bets  []lottery.Bet
+	Frame protocol.Frame
+}
+
+// Len Returns the amount of bets in the batch. The server ack of the batch
+// must refer to the same amount
+func (b Batch) Len() int {
+	return len(b.Bets)
+}
+
+// newSessionID Returns a random, non zero ID for the batches of a client
+func newSessionID() (uint64, error) {
+	var id [8]byte
+	for {
+		if _, err := rand.Read(id[:]); err != nil {
+			return 0, errors.Wrap(err, "generate batch session")
+		}
+		if session := binary.BigEndian.Uint64(id[:]); session != 0 {
+			return session, nil
+		}
+	}
+}
+
+// batchMaxBytes Size budget of the batches of the client. It never exceeds
+// the maximum frame size and leaves room for the authentication envelope if
+// the frames are sealed
+func (c *Client) batchMaxBytes() int {
+	maxBytes := c.config.BatchMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultBatchMaxBytes
+	}
+	if maxFrameSize := c.maxFrameSize(); maxBytes > maxFrameSize {
+		maxBytes = maxFrameSize
+	}
+	if c.config.AuthSecret != nil {
+		maxBytes -= protocol.AuthOverhead
+	}
+	return maxBytes
+}
+
+// BatchBuilder Groups the bets of a source in batches of at most maxAmount
+// bets whose frames never exceed maxBytes
+type BatchBuilder struct {
+	source    BetSource
+	maxAmount int
+	maxBytes  int
+	encoder   *protocol.BatchEncoder
+	// pending Bet read from the source that did not fit in the last batch
+	pending *lottery.Bet
+}
+
+// NewBatchBuilder Initializes a batch builder. A non positive maxBytes
+// means DefaultBatchMaxBytes and a non positive maxAmount means that
+// batches are only limited by their size
+func NewBatchBuilder(source BetSource, maxAmount int, maxBytes int) *BatchBuilder {
+	if maxBytes <= 0 {
+		maxBytes = DefaultBatchMaxBytes
+	}
+	return &BatchBuilder{
+		source:    source,
+		maxAmount: maxAmount,
+		maxBytes:  maxBytes,
+		encoder:   protocol.NewBatchEncoder(),
+	}
+}
+
+// Next Returns the next batch. A batch is closed when it reaches maxAmount
+// bets or when the next bet would push its frame over maxBytes. io.EOF is
+// returned once the source is exhausted and every bet was returned
+func (b *BatchBuilder) Next() (Batch, error) {
+	b.encoder.Reset()
+	var bets []lottery.Bet
+
+	for b.maxAmount <= 0 || len(bets) < b.maxAmount {
+		bet, err := b.nextBet()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Batch{}, err
+		}
+
+		fits, err := b.encoder.TryAdd(bet, b.maxBytes)
+		if err != nil {
+			return Batch{}, err
+		}
+		if !fits {
+			if len(bets) == 0 {
+				return Batch{}, errors.Wrapf(ErrBetTooLarge, "dni: %v", bet.Document)
+			}
+			b.pending = &bet
+			break
+		}
+		bets = append(bets, bet)
+	}
+
+	if len(bets) == 0 {
+		return Batch{}, io.EOF
+	}
+	return Batch{Bets: bets, Frame: b.encoder.Frame()}, nil
+}
+
+func (b *BatchBuilder) nextBet() (lottery.Bet, error) {
+	if b.pending != nil {
+		bet := *b.pending
+		b.pending = nil
+		return bet, nil
+	}
+	return b.source.Next()
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Checkpoint Progress of the submission of a dataset: the amount of rows
+// from the start of the dataset whose batches were acknowledged, and the
+// session and sequence number of the last of those batches. The batch
+// limits are kept too, since a resent batch only carries the same rows as
+// the original one if the dataset is split in the same way
+type Checkpoint struct {
+	Agency         int    `json:"agency"`
+	Dataset        string `json:"dataset"`
+	Fingerprint    string `json:"fingerprint"`
+	BatchMaxAmount int    `json:"batch_max_amount"`
+	BatchMaxBytes  int    `json:"batch_max_bytes"`
+	Rows           int    `json:"rows"`
+	Session        uint64 `json:"session"`
+	Sequence       uint32 `json:"sequence"`
+}
+
+// sameDataset Checks whether both checkpoints belong to the same dataset
+// of the same agency
+func (c Checkpoint) sameDataset(other Checkpoint) bool {
+	return c.Agency == other.Agency && c.Dataset == other.Dataset && c.Fingerprint == other.Fingerprint
+}
+
+// sameBatches Checks whether both checkpoints split the dataset in batches
+// the same way
+func (c Checkpoint) sameBatches(other Checkpoint) bool {
+	return c.BatchMaxAmount == other.BatchMaxAmount && c.BatchMaxBytes == other.BatchMaxBytes
+}
+
+// checkpointFile Checkpoint kept in a local file, rewritten after every
+// acknowledged batch
+type checkpointFile struct {
+	path  string
+	state Checkpoint
+}
+
+// openCheckpoint Opens the checkpoint file at path for the submission
+// described by current, whose Rows, Session and Sequence are ignored.
+// Returns the checkpoint stored in the file, or nil if there is none or it
+// was left by a different dataset or agency
+func openCheckpoint(path string, current Checkpoint) (*checkpointFile, *Checkpoint, error) {
+	current.Rows, current.Session, current.Sequence = 0, 0, 0
+	file := &checkpointFile{path: path, state: current}
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return file, nil, nil
+	}
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "read checkpoint %s", path)
+	}
+
+	var stored Checkpoint
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, nil, errors.Wrapf(err, "parse checkpoint %s", path)
+	}
+	if !stored.sameDataset(current) || stored.Rows < 0 {
+		return file, nil, nil
+	}
+	file.state.Rows = stored.Rows
+	return file, &stored, nil
+}
+
+// advance Records that rows more rows were acknowledged, the last of them
+// in the batch with the given session and sequence number. The file is
+// replaced atomically, so a crash leaves either the old or the new
+// checkpoint
+func (f *checkpointFile) advance(rows int, session uint64, sequence uint32) error {
+	state := f.state
+	state.Rows += rows
+	state.Session = session
+	state.Sequence = sequence
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "create checkpoint")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "write checkpoint")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "sync checkpoint")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "close checkpoint")
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return errors.Wrap(err, "replace checkpoint")
+	}
+	if err := syncDir(filepath.Dir(f.path)); err != nil {
+		return errors.Wrap(err, "sync checkpoint directory")
+	}
+
+	f.state = state
+	return nil
+}
+
+// remove Deletes the checkpoint once the dataset is fully submitted
+func (f *checkpointFile) remove() error {
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// syncDir Flushes a directory so a rename inside it survives a crash
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,199 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testCheckpoint Submission of the tests, without progress
+var testCheckpoint = Checkpoint{
+	Agency:         1,
+	Dataset:        "agency-1.csv",
+	Fingerprint:    "sha256:abcd",
+	BatchMaxAmount: 100,
+	BatchMaxBytes:  DefaultBatchMaxBytes,
+}
+
+// checkOnlyFile Checks that the checkpoint file is the only file in its
+// directory, so no temporary file was left behind
+func checkOnlyFile(t *testing.T, path string) {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(path) {
+		names := make([]string, len(entries))
+		for i, entry := range entries {
+			names[i] = entry.Name()
+		}
+		t.Errorf("checkpoint directory holds %v, want only %v", names, filepath.Base(path))
+	}
+}
+
+func TestCheckpointAdvance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	file, stored, err := openCheckpoint(path, testCheckpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != nil {
+		t.Fatalf("checkpoint %+v read before any was written", *stored)
+	}
+
+	if err := file.advance(100, 10, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.advance(40, 10, 2); err != nil {
+		t.Fatal(err)
+	}
+	checkOnlyFile(t, path)
+
+	_, stored, err = openCheckpoint(path, testCheckpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testCheckpoint
+	want.Rows, want.Session, want.Sequence = 140, 10, 2
+	if stored == nil || *stored != want {
+		t.Errorf("checkpoint %+v, want %+v", stored, want)
+	}
+}
+
+func TestCheckpointFailedAdvance(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checkpoint.json")
+	file, _, err := openCheckpoint(path, testCheckpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.advance(100, 10, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory cannot be replaced by the new checkpoint
+	file.path = filepath.Join(dir, "busy")
+	if err := os.MkdirAll(filepath.Join(file.path, "entry"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.advance(40, 10, 2); err == nil {
+		t.Fatal("advance over a directory succeeded")
+	}
+	if err := os.RemoveAll(file.path); err != nil {
+		t.Fatal(err)
+	}
+	file.path = path
+	checkOnlyFile(t, path)
+
+	// The failed advance is not counted
+	if err := file.advance(40, 10, 2); err != nil {
+		t.Fatal(err)
+	}
+	_, stored, err := openCheckpoint(path, testCheckpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == nil || stored.Rows != 140 {
+		t.Errorf("checkpoint %+v, want 140 rows", stored)
+	}
+}
+
+func TestCheckpointOfAnotherSubmission(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Checkpoint)
+		reused bool
+	}{
+		{"same submission", func(*Checkpoint) {}, true},
+		{"other agency", func(c *Checkpoint) { c.Agency = 2 }, false},
+		{"other dataset", func(c *Checkpoint) { c.Dataset = "agency-2.csv" }, false},
+		{"modified dataset", func(c *Checkpoint) { c.Fingerprint = "sha256:dcba" }, false},
+		{"other batch limits", func(c *Checkpoint) { c.BatchMaxAmount = 50 }, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "checkpoint.json")
+			file, _, err := openCheckpoint(path, testCheckpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := file.advance(100, 10, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			current := testCheckpoint
+			test.change(&current)
+			file, stored, err := openCheckpoint(path, current)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stored != nil; got != test.reused {
+				t.Fatalf("checkpoint reused: %v, want %v", got, test.reused)
+			}
+			// Progress continues from the reused checkpoint or from the start
+			wantRows := 0
+			if test.reused {
+				wantRows = 100
+			}
+			if file.state.Rows != wantRows || file.state.Agency != current.Agency || file.state.BatchMaxAmount != current.BatchMaxAmount {
+				t.Errorf("checkpoint state %+v, want %v rows of %+v", file.state, wantRows, current)
+			}
+		})
+	}
+}
+
+func TestRestoreCheckpoint(t *testing.T) {
+	tests := []struct {
+		name           string
+		batchMaxAmount int
+		session        uint64
+		sequence       uint32
+	}{
+		{"same batch limits", 100, 10, 3},
+		// The batches would not match the ones already sent
+		{"other batch limits", 50, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			datasetPath := writeDataset(t, 10)
+			dataset, err := OpenDataset(datasetPath, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dataset.Close()
+
+			config := ClientConfig{
+				ID:             "1",
+				DatasetPath:    datasetPath,
+				BatchMaxAmount: 100,
+				CheckpointPath: filepath.Join(t.TempDir(), "checkpoint.json"),
+			}
+			previous := NewClient(config)
+			if err := previous.restoreCheckpoint(1, dataset); err != nil {
+				t.Fatal(err)
+			}
+			if err := previous.checkpoint.advance(4, 10, 3); err != nil {
+				t.Fatal(err)
+			}
+
+			config.BatchMaxAmount = test.batchMaxAmount
+			client := NewClient(config)
+			if err := client.restoreCheckpoint(1, dataset); err != nil {
+				t.Fatal(err)
+			}
+			if client.session != test.session || client.sequence != test.sequence {
+				t.Errorf("session %v and sequence %v, want %v and %v", client.session, client.sequence, test.session, test.sequence)
+			}
+
+			// The rows of the checkpoint are skipped either way
+			bet, err := dataset.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bet.Number != 4 {
+				t.Errorf("first bet after the checkpoint has number %v, want 4", bet.Number)
+			}
+		})
+	}
+}
@@ -1,12 +1,21 @@
 package common
 
 import (
-	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
 )
 
 var log = logging.MustGetLogger("log")
@@ -15,14 +24,152 @@ var log = logging.MustGetLogger("log")
 type ClientConfig struct {
 	ID            string
 	ServerAddress string
+	Mode          Mode
 	LoopAmount    int
 	LoopPeriod    time.Duration
+	MaxFrameSize  int
+	// Bet Bet sent by ModeBet
+	Bet lottery.Bet
+	// DatasetPath Dataset sent by ModeBatch. See OpenDataset
+	DatasetPath string
+	// CheckpointPath File where the progress of the dataset submission is
+	// kept to resume it after a restart. Empty disables checkpoints
+	CheckpointPath string
+	BatchMaxAmount int
+	BatchMaxBytes  int
+	OnReject       RejectPolicy
+	// BatchRetries Amount of times a batch is resent after its exchange
+	// failed because of the connection. Safe because batches are sequenced
+	BatchRetries    int
+	BatchBackoff    time.Duration
+	BatchMaxBackoff time.Duration
+	// WinnersRetries Amount of winners or draw queries sent while the draw
+	// is pending. Zero means no limit
+	WinnersRetries    int
+	WinnersBackoff    time.Duration
+	WinnersMaxBackoff time.Duration
+	// WinnersPublicKey Key whose signature every winners response must carry.
+	// Nil accepts unsigned responses
+	WinnersPublicKey ed25519.PublicKey
+	// DrawCommitment Commitment of the draw recorded before the bets closed,
+	// checked by ModeVerifyDraw. Empty trusts the one the server reports
+	DrawCommitment string
+	ConnectionMode ConnectionMode
+	// ConnectRetries Amount of times a failed dial is retried
+	ConnectRetries    int
+	ConnectBackoff    time.Duration
+	ConnectMaxBackoff time.Duration
+	ConnectTimeout    time.Duration
+	// ShutdownGrace Time given to the exchange in progress to finish once
+	// the context of the operation is cancelled
+	ShutdownGrace time.Duration
+	// ReadTimeout and WriteTimeout bound every read and write of a message.
+	// Zero means no timeout
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// IdleTimeout Persistent connections unused for longer than this are
+	// closed and dialed again before the next message. Zero means no timeout
+	IdleTimeout time.Duration
+	// TLS Configuration of the connections to the server. Nil connects
+	// without TLS. See LoadTLSConfig
+	TLS *tls.Config
+	// AuthSecret Secret shared with the server that authenticates every
+	// frame with HMAC-SHA256. Nil sends the frames as they are
+	AuthSecret []byte
+}
+
+// Mode Selects what Run does
+type Mode string
+
+const (
+	// ModeEcho Sends LoopAmount echo messages
+	ModeEcho Mode = "echo"
+	// ModeBet Sends the configured bet
+	ModeBet Mode = "bet"
+	// ModeBatch Records the commitment of the draw, sends the configured
+	// dataset in batches, notifies the end of the bets and queries the
+	// winners of the agency
+	ModeBatch Mode = "batch"
+	// ModeVerifyDraw Checks that the seed revealed after the draw matches
+	// its commitment and that the winning number was derived from it
+	ModeVerifyDraw Mode = "verify-draw"
+)
+
+// ConnectionMode Decides whether the client keeps its connection to the
+// server between messages
+type ConnectionMode string
+
+const (
+	// ConnectionPerMessage Dials a new connection for every message
+	ConnectionPerMessage ConnectionMode = "per_message"
+	// ConnectionPersistent Keeps a single connection for the whole session
+	// and redials it after errors
+	ConnectionPersistent ConnectionMode = "persistent"
+)
+
+// RejectPolicy Decides what the client does after the server rejects a batch
+type RejectPolicy string
+
+const (
+	// RejectStop Stops the submission at the first rejected batch
+	RejectStop RejectPolicy = "stop"
+	// RejectContinue Logs the rejected batch and keeps sending the next ones
+	RejectContinue RejectPolicy = "continue"
+)
+
+var (
+	// ErrBatchRejected Returned under RejectStop when the server answers a
+	// batch with an error code
+	ErrBatchRejected = errors.New("batch rejected by server")
+	// ErrDrawPending Returned when the draw did not take place after every
+	// winners query retry
+	ErrDrawPending = errors.New("draw has not taken place")
+	// ErrDrawNotSeeded Returned by VerifyDraw when the winning number of the
+	// draw was not derived from its seed, so there is nothing to verify
+	ErrDrawNotSeeded = errors.New("draw is not seeded")
+	// ErrDrawMismatch Returned when the winners response belongs to a draw
+	// other than the one committed to before the bets were sent
+	ErrDrawMismatch = errors.New("winners response of another draw")
+	// ErrAborted Returned when an exchange did not finish within the
+	// shutdown grace period after its context was cancelled
+	ErrAborted = errors.New("exchange aborted")
+)
+
+// OpError Error returned by the client operations. Op is the name of the
+// operation that failed, the same one used as action in the logs
+type OpError struct {
+	Op       string
+	ClientID string
+	Err      error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("client %v: %v: %v", e.ClientID, e.Op, e.Err)
+}
+
+// Unwrap Returns the underlying error
+func (e *OpError) Unwrap() error {
+	return e.Err
 }
 
 // Client Entity that encapsulates how
 type Client struct {
 	config ClientConfig
 	conn   net.Conn
+	// lastUsed Time the last exchange through conn finished
+	lastUsed time.Time
+	// nonce Last nonce used to seal a frame
+	nonce uint64
+	// session Random ID of the batches sent by the client and sequence the
+	// number of the last batch sent in it
+	session  uint64
+	sequence uint32
+	// checkpoint Progress of the dataset being submitted, nil if
+	// checkpoints are disabled
+	checkpoint *checkpointFile
+	// commitment Commitment of the draw reported by the server before the
+	// bets were sent, empty if it was not queried
+	commitment string
 }
 
 // NewClient Initializes a new client receiving the configuration
@@ -34,56 +181,774 @@ func NewClient(config ClientConfig) *Client {
 	return client
 }
 
-// CreateClientSocket Initializes client socket. In case of
-// failure, error is printed in stdout/stderr and exit 1
-// is returned
-func (c *Client) createClientSocket() error {
-	conn, err := net.Dial("tcp", c.config.ServerAddress)
-	if err != nil {
-		log.Criticalf(
-			"action: connect | result: fail | client_id: %v | error: %v",
+// opError Wraps err in an *OpError for the given operation
+func (c *Client) opError(op string, err error) error {
+	return &OpError{Op: op, ClientID: c.config.ID, Err: err}
+}
+
+// sleep Waits the given time unless ctx is done meanwhile, in which case
+// the error of the context is returned
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run Executes the configured mode until it finishes or ctx is done. Once
+// ctx is done no new messages are sent. The returned error, if any, is an
+// *OpError
+func (c *Client) Run(ctx context.Context) error {
+	if err := c.config.validate(); err != nil {
+		log.Criticalf("action: config | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return c.opError("config", err)
+	}
+
+	switch c.config.Mode {
+	case "", ModeEcho:
+		return c.EchoLoop(ctx)
+	case ModeBet:
+		return c.SendBet(ctx, c.config.Bet)
+	case ModeBatch:
+		return c.SubmitDataset(ctx)
+	case ModeVerifyDraw:
+		return c.VerifyDraw(ctx)
+	default:
+		err := errors.Errorf("unknown mode %q", c.config.Mode)
+		log.Criticalf("action: config | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return c.opError("config", err)
+	}
+}
+
+// validate Checks the options that only accept a fixed set of values, so a
+// typo is reported instead of falling back to the default. Empty values
+// mean the default
+func (config ClientConfig) validate() error {
+	switch config.OnReject {
+	case "", RejectStop, RejectContinue:
+	default:
+		return errors.Errorf("unknown batch reject policy %q", config.OnReject)
+	}
+	switch config.ConnectionMode {
+	case "", ConnectionPerMessage, ConnectionPersistent:
+	default:
+		return errors.Errorf("unknown connection mode %q", config.ConnectionMode)
+	}
+	return nil
+}
+
+// createClientSocket Initializes client socket. Dialing is retried up to
+// ConnectRetries times with capped exponential backoff and every attempt
+// gives up after ConnectTimeout or when ctx is done. Each failed attempt is
+// logged and the error of the last one is returned
+func (c *Client) createClientSocket(ctx context.Context) error {
+	dialer := c.dialer()
+	wait := newBackoff(c.config.ConnectBackoff, c.config.ConnectMaxBackoff)
+
+	for attempt := 1; ; attempt++ {
+		conn, err := dialer.DialContext(ctx, "tcp", c.config.ServerAddress)
+		if err == nil {
+			log.Debugf("action: connect | result: success | client_id: %v | attempt: %v", c.config.ID, attempt)
+			c.conn = conn
+			return nil
+		}
+
+		if attempt > c.config.ConnectRetries || ctx.Err() != nil {
+			log.Errorf("action: connect | result: fail | client_id: %v | attempt: %v | error: %v",
+				c.config.ID,
+				attempt,
+				err,
+			)
+			return err
+		}
+
+		delay := wait.next()
+		log.Warningf("action: connect | result: retry | client_id: %v | attempt: %v | retry_in: %v | error: %v",
 			c.config.ID,
+			attempt,
+			delay,
 			err,
 		)
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
 	}
-	c.conn = conn
-	return nil
 }
 
-// StartClientLoop Send messages to the client until some time threshold is met
-func (c *Client) StartClientLoop() {
+// EchoLoop Send messages to the client until some time threshold is met
+// or ctx is done
+func (c *Client) EchoLoop(ctx context.Context) error {
 	// There is an autoincremental msgID to identify every message sent
 	// Messages if the message amount threshold has not been surpassed
 	for msgID := 1; msgID <= c.config.LoopAmount; msgID++ {
-		// Create the connection the server in every loop iteration. Send an
-		c.createClientSocket()
+		msg, err := c.request(ctx, protocol.Frame{
+			Type:    protocol.MsgEcho,
+			Payload: []byte(fmt.Sprintf("[CLIENT %v] Message N°%v", c.config.ID, msgID)),
+		})
 
-		// TODO: Modify the send to avoid short-write
-		fmt.Fprintf(
-			c.conn,
-			"[CLIENT %v] Message N°%v\n",
+		if err != nil {
+			log.Errorf("action: receive_message | result: fail | client_id: %v | error_kind: %v | error: %v",
+				c.config.ID,
+				errorKind(err),
+				err,
+			)
+			return c.opError("receive_message", err)
+		}
+
+		log.Infof("action: receive_message | result: success | client_id: %v | msg: %s",
 			c.config.ID,
-			msgID,
+			msg.Payload,
+		)
+
+		// Wait a time between sending one message and the next one
+		if err := sleep(ctx, c.config.LoopPeriod); err != nil {
+			log.Infof("action: loop_finished | result: interrupted | client_id: %v", c.config.ID)
+			return c.opError("loop_finished", err)
+		}
+
+	}
+	log.Infof("action: loop_finished | result: success | client_id: %v", c.config.ID)
+	return nil
+}
+
+// SendBet Sends a single bet to the server and waits for its confirmation.
+// The bet is validated before being sent and the outcome is logged
+func (c *Client) SendBet(ctx context.Context, bet lottery.Bet) error {
+	err := c.sendBet(ctx, bet)
+	if err != nil {
+		log.Errorf("action: apuesta_enviada | result: fail | dni: %v | numero: %v | error: %v",
+			bet.Document,
+			bet.Number,
+			err,
 		)
-		msg, err := bufio.NewReader(c.conn).ReadString('\n')
-		c.conn.Close()
+		return c.opError("apuesta_enviada", err)
+	}
+
+	log.Infof("action: apuesta_enviada | result: success | dni: %v | numero: %v",
+		bet.Document,
+		bet.Number,
+	)
+	return nil
+}
 
+func (c *Client) sendBet(ctx context.Context, bet lottery.Bet) error {
+	if err := bet.Validate(); err != nil {
+		return err
+	}
+	request, err := protocol.EncodeBet(bet)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.request(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	ack, err := protocol.DecodeAck(response)
+	if err != nil {
+		return err
+	}
+	if ack.Code != protocol.AckSuccess {
+		return errors.Errorf("bet rejected by server: %v", ack.Code)
+	}
+	return nil
+}
+
+// SubmitDataset Records the commitment of the draw, sends every bet of the
+// configured dataset, notifies the server that the agency has finished and
+// queries its winners. Under RejectContinue the agency finishes without the
+// bets of the rejected batches
+func (c *Client) SubmitDataset(ctx context.Context) error {
+	agency, err := c.agency()
+	if err != nil {
+		return c.opError("open_dataset", err)
+	}
+	dataset, err := OpenDataset(c.config.DatasetPath, agency)
+	if err != nil {
+		log.Criticalf("action: open_dataset | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return c.opError("open_dataset", err)
+	}
+
+	err = c.restoreCheckpoint(agency, dataset)
+	if err == nil {
+		_, err = c.QueryCommitment(ctx)
+	}
+	var rejected int
+	if err == nil {
+		rejected, err = c.SendBatches(ctx, dataset)
+	}
+	if closeErr := dataset.Close(); closeErr != nil {
+		log.Errorf("action: shutdown | result: fail | client_id: %v | resource: dataset | error: %v", c.config.ID, closeErr)
+	} else {
+		log.Infof("action: shutdown | result: success | client_id: %v | resource: dataset", c.config.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if rejected > 0 {
+		// The rejected bets would be rejected again, so the agency finishes
+		// without them
+		log.Warningf("action: enviar_dataset | result: success | client_id: %v | lotes_rechazados: %v", c.config.ID, rejected)
+	}
+
+	if err := c.NotifyFinished(ctx); err != nil {
+		return err
+	}
+	c.removeCheckpoint()
+	_, err = c.QueryWinners(ctx)
+	return err
+}
+
+// restoreCheckpoint Opens the checkpoint of the dataset, if enabled, and
+// skips the rows whose batches were already acknowledged. The batches keep
+// the session and sequence numbers of the checkpoint, so the server
+// recognizes a batch it stored after the checkpoint was last written.
+// If the batch limits changed the batches cannot match the original ones,
+// so a new session is used instead
+func (c *Client) restoreCheckpoint(agency int, dataset *DatasetReader) error {
+	if c.config.CheckpointPath == "" {
+		return nil
+	}
+	current := Checkpoint{
+		Agency:         agency,
+		Dataset:        c.config.DatasetPath,
+		Fingerprint:    dataset.Fingerprint(),
+		BatchMaxAmount: c.config.BatchMaxAmount,
+		BatchMaxBytes:  c.batchMaxBytes(),
+	}
+	checkpoint, stored, err := openCheckpoint(c.config.CheckpointPath, current)
+	if err == nil && stored != nil {
+		err = dataset.Skip(stored.Rows)
+	}
+	if err != nil {
+		log.Errorf("action: restaurar_checkpoint | result: fail | client_id: %v | path: %v | error: %v", c.config.ID, c.config.CheckpointPath, err)
+		return c.opError("restaurar_checkpoint", err)
+	}
+
+	c.checkpoint = checkpoint
+	if stored == nil {
+		return nil
+	}
+	if stored.sameBatches(current) {
+		c.session, c.sequence = stored.Session, stored.Sequence
+	} else {
+		log.Warningf("action: restaurar_checkpoint | result: in_progress | client_id: %v | error: batch limits changed, the last batch may be stored twice", c.config.ID)
+	}
+	log.Infof("action: restaurar_checkpoint | result: success | client_id: %v | filas: %v | secuencia: %v", c.config.ID, stored.Rows, c.sequence)
+	return nil
+}
+
+// removeCheckpoint Deletes the checkpoint of the submitted dataset. A
+// failure is only logged since the bets were already notified
+func (c *Client) removeCheckpoint() {
+	if c.checkpoint == nil {
+		return
+	}
+	if err := c.checkpoint.remove(); err != nil {
+		log.Errorf("action: borrar_checkpoint | result: fail | client_id: %v | path: %v | error: %v", c.config.ID, c.checkpoint.path, err)
+	}
+	c.checkpoint = nil
+}
+
+// SendBatches Sends every bet of the source to the server grouped in
+// batches and waits for the ack of each batch before sending the next one.
+// Transport errors always stop the submission while rejected batches stop
+// it or not according to the configured RejectPolicy. Under RejectContinue
+// the rejected batches are not an error, their amount is returned instead
+func (c *Client) SendBatches(ctx context.Context, source BetSource) (rejected int, err error) {
+	builder := NewBatchBuilder(source, c.config.BatchMaxAmount, c.batchMaxBytes())
+
+	if c.session == 0 {
+		session, err := newSessionID()
 		if err != nil {
-			log.Errorf("action: receive_message | result: fail | client_id: %v | error: %v",
+			return 0, c.opError("apuesta_recibida", err)
+		}
+		c.session = session
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return rejected, c.opError("apuesta_recibida", err)
+		}
+		batch, err := builder.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Errorf("action: read_dataset | result: fail | client_id: %v | error: %v",
 				c.config.ID,
 				err,
 			)
-			return
+			return rejected, c.opError("read_dataset", err)
+		}
+
+		c.sequence++
+		if err := protocol.SetBatchSequence(batch.Frame, c.session, c.sequence); err != nil {
+			return rejected, c.opError("apuesta_recibida", err)
+		}
+		ack, err := c.sendBatch(ctx, batch)
+		if err != nil {
+			log.Errorf("action: apuesta_recibida | result: fail | client_id: %v | cantidad: %v | error_kind: %v | error: %v",
+				c.config.ID,
+				batch.Len(),
+				errorKind(err),
+				err,
+			)
+			return rejected, c.opError("apuesta_recibida", err)
 		}
 
-		log.Infof("action: receive_message | result: success | client_id: %v | msg: %v",
+		if ack.Code != protocol.AckSuccess {
+			log.Errorf("action: apuesta_recibida | result: fail | client_id: %v | cantidad: %v | codigo: %v",
+				c.config.ID,
+				batch.Len(),
+				ack.Code,
+			)
+			rejected++
+			if c.config.OnReject != RejectContinue {
+				return rejected, c.opError("apuesta_recibida", errors.Wrapf(ErrBatchRejected, "code %v", ack.Code))
+			}
+		} else {
+			log.Infof("action: apuesta_recibida | result: success | client_id: %v | cantidad: %v",
+				c.config.ID,
+				batch.Len(),
+			)
+		}
+
+		if err := c.advanceCheckpoint(batch); err != nil {
+			return rejected, err
+		}
+	}
+	return rejected, nil
+}
+
+// advanceCheckpoint Records the rows of an acknowledged batch. Batches
+// rejected under RejectContinue are recorded as well, since the server
+// would reject them again
+func (c *Client) advanceCheckpoint(batch Batch) error {
+	if c.checkpoint == nil {
+		return nil
+	}
+	if err := c.checkpoint.advance(batch.Len(), c.session, c.sequence); err != nil {
+		log.Errorf("action: guardar_checkpoint | result: fail | client_id: %v | path: %v | error: %v", c.config.ID, c.checkpoint.path, err)
+		return c.opError("guardar_checkpoint", err)
+	}
+	return nil
+}
+
+// sendBatch Sends a sequenced batch and returns the ack of the server. The
+// ack must refer to every bet of the batch. If the exchange fails because
+// of the connection the batch is resent up to BatchRetries times with
+// exponential backoff, since the server answers a batch it already stored
+// with its ack instead of storing it again
+func (c *Client) sendBatch(ctx context.Context, batch Batch) (protocol.Ack, error) {
+	wait := newBackoff(c.config.BatchBackoff, c.config.BatchMaxBackoff)
+
+	for attempt := 1; ; attempt++ {
+		ack, err := c.trySendBatch(ctx, batch)
+		var netErr *NetError
+		if err == nil || !errors.As(err, &netErr) || attempt > c.config.BatchRetries {
+			return ack, err
+		}
+
+		delay := wait.next()
+		log.Warningf("action: apuesta_recibida | result: retry | client_id: %v | secuencia: %v | attempt: %v | retry_in: %v | error_kind: %v | error: %v",
 			c.config.ID,
-			msg,
+			c.sequence,
+			attempt,
+			delay,
+			errorKind(err),
+			err,
 		)
+		if err := sleep(ctx, delay); err != nil {
+			return protocol.Ack{}, err
+		}
+	}
+}
 
-		// Wait a time between sending one message and the next one
-		time.Sleep(c.config.LoopPeriod)
+// trySendBatch Sends a batch once and returns the ack of the server
+func (c *Client) trySendBatch(ctx context.Context, batch Batch) (protocol.Ack, error) {
+	response, err := c.request(ctx, batch.Frame)
+	if err != nil {
+		return protocol.Ack{}, err
+	}
 
+	ack, err := protocol.DecodeAck(response)
+	if err != nil {
+		return protocol.Ack{}, err
 	}
-	log.Infof("action: loop_finished | result: success | client_id: %v", c.config.ID)
+	if int(ack.Count) != batch.Len() {
+		return protocol.Ack{}, errors.Errorf("ack for %d bets, batch had %d", ack.Count, batch.Len())
+	}
+	return ack, nil
+}
+
+// NotifyFinished Tells the server that the agency has sent all its bets
+func (c *Client) NotifyFinished(ctx context.Context) error {
+	err := c.notifyFinished(ctx)
+	if err != nil {
+		log.Errorf("action: notificar_fin | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return c.opError("notificar_fin", err)
+	}
+	log.Infof("action: notificar_fin | result: success | client_id: %v", c.config.ID)
+	return nil
+}
+
+func (c *Client) notifyFinished(ctx context.Context) error {
+	agency, err := c.agency()
+	if err != nil {
+		return err
+	}
+	response, err := c.request(ctx, protocol.EncodeFinished(agency))
+	if err != nil {
+		return err
+	}
+	ack, err := protocol.DecodeAck(response)
+	if err != nil {
+		return err
+	}
+	if ack.Code != protocol.AckSuccess {
+		return errors.Errorf("notification rejected by server: %v", ack.Code)
+	}
+	return nil
+}
+
+// QueryWinners Requests the winners of the agency and the prize tier each
+// one won. While the server answers that the draw is pending the query is
+// retried with exponential backoff
+func (c *Client) QueryWinners(ctx context.Context) ([]protocol.Winner, error) {
+	winners, err := c.queryWinners(ctx)
+	if errors.Is(err, protocol.ErrInvalidSignature) || errors.Is(err, ErrDrawMismatch) {
+		log.Criticalf("action: consulta_ganadores | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return nil, c.opError("consulta_ganadores", err)
+	}
+	if err != nil {
+		log.Errorf("action: consulta_ganadores | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return nil, c.opError("consulta_ganadores", err)
+	}
+	for _, winner := range winners {
+		log.Debugf("action: ganador | result: success | client_id: %v | dni: %v | premio: %v", c.config.ID, winner.Document, winner.Tier)
+	}
+	log.Infof("action: consulta_ganadores | result: success | cant_ganadores: %v", len(winners))
+	return winners, nil
+}
+
+func (c *Client) queryWinners(ctx context.Context) ([]protocol.Winner, error) {
+	agency, err := c.agency()
+	if err != nil {
+		return nil, err
+	}
+
+	var winners protocol.WinnersPage
+	err = c.retryWhileDrawPending(ctx, "consulta_ganadores", func() (bool, error) {
+		page, drawn, err := c.queryWinnersPage(ctx, agency, 0)
+		winners = page
+		return drawn, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for !winners.Complete() {
+		page, _, err := c.queryWinnersPage(ctx, agency, len(winners.Winners))
+		if err != nil {
+			return nil, err
+		}
+		if err := winners.Append(page); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.verifyWinners(agency, winners.WinnersResponse); err != nil {
+		return nil, err
+	}
+	return winners.Winners, nil
+}
+
+// queryWinnersPage Requests the page of the winners of the agency that
+// starts at offset. drawn is false if the server answered that the draw is
+// pending
+func (c *Client) queryWinnersPage(ctx context.Context, agency int, offset int) (page protocol.WinnersPage, drawn bool, err error) {
+	response, err := c.request(ctx, protocol.EncodeWinnersQuery(protocol.WinnersQuery{
+		Agency:       agency,
+		Offset:       offset,
+		MaxFrameSize: c.maxFrameSize(),
+	}))
+	if err != nil {
+		return protocol.WinnersPage{}, false, err
+	}
+	if response.Type == protocol.MsgWinners {
+		page, err = protocol.DecodeWinners(response)
+		return page, true, err
+	}
+
+	ack, err := protocol.DecodeAck(response)
+	if err != nil {
+		return protocol.WinnersPage{}, false, err
+	}
+	if ack.Code != protocol.AckDrawPending || offset > 0 {
+		return protocol.WinnersPage{}, false, errors.Errorf("winners query rejected by server: %v", ack.Code)
+	}
+	return protocol.WinnersPage{}, false, nil
+}
+
+// verifyWinners Checks that the response refers to the agency and, if a
+// public key is configured, that it carries a valid signature. The draw of
+// the response must be DrawCommitment or, if it is not configured, the
+// commitment reported before the bets were sent, if any
+func (c *Client) verifyWinners(agency int, response protocol.WinnersResponse) error {
+	if c.config.WinnersPublicKey != nil {
+		if err := protocol.VerifyWinners(c.config.WinnersPublicKey, response); err != nil {
+			return err
+		}
+	}
+	if response.Agency != agency {
+		return errors.Errorf("winners response for agency %d, expected %d", response.Agency, agency)
+	}
+	commitment := c.config.DrawCommitment
+	if commitment == "" {
+		commitment = c.commitment
+	}
+	if commitment != "" && !strings.EqualFold(strings.TrimSpace(commitment), response.DrawID) {
+		return errors.Wrapf(ErrDrawMismatch, "draw %v, expected %v", response.DrawID, commitment)
+	}
+	return nil
+}
+
+// retryWhileDrawPending Calls query until it reports that the draw took
+// place or fails, waiting with exponential backoff between calls. After
+// WinnersRetries calls ErrDrawPending is returned
+func (c *Client) retryWhileDrawPending(ctx context.Context, action string, query func() (drawn bool, err error)) error {
+	wait := newBackoff(c.config.WinnersBackoff, c.config.WinnersMaxBackoff)
+
+	for attempt := 1; ; attempt++ {
+		drawn, err := query()
+		if err != nil || drawn {
+			return err
+		}
+		if c.config.WinnersRetries > 0 && attempt >= c.config.WinnersRetries {
+			return errors.Wrapf(ErrDrawPending, "after %d queries", attempt)
+		}
+
+		delay := wait.next()
+		log.Debugf("action: %v | result: in_progress | client_id: %v | retry_in: %v", action, c.config.ID, delay)
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// queryDraw Requests the public information of the draw
+func (c *Client) queryDraw(ctx context.Context) (protocol.DrawInfo, error) {
+	response, err := c.request(ctx, protocol.EncodeDrawQuery())
+	if err != nil {
+		return protocol.DrawInfo{}, err
+	}
+	return protocol.DecodeDraw(response)
+}
+
+// QueryCommitment Requests the commitment of the draw and logs it, so the
+// agency keeps the hash of the seed published before its bets close. The
+// commitment is kept to check the draw of the winners response
+func (c *Client) QueryCommitment(ctx context.Context) (string, error) {
+	info, err := c.queryDraw(ctx)
+	if err != nil {
+		log.Errorf("action: compromiso_sorteo | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return "", c.opError("compromiso_sorteo", err)
+	}
+	log.Infof("action: compromiso_sorteo | result: success | client_id: %v | compromiso: %v", c.config.ID, info.Commitment)
+	c.commitment = info.Commitment
+	return info.Commitment, nil
+}
+
+// VerifyDraw Waits for the draw to take place and checks that the revealed
+// seed matches the commitment and that the winning number was derived from
+// it. The commitment checked is DrawCommitment or, if it is not configured,
+// the one the server reports. Draws that are not seeded fail with
+// ErrDrawNotSeeded
+func (c *Client) VerifyDraw(ctx context.Context) error {
+	var info protocol.DrawInfo
+	err := c.retryWhileDrawPending(ctx, "verificar_sorteo", func() (bool, error) {
+		var err error
+		info, err = c.queryDraw(ctx)
+		return info.Revealed(), err
+	})
+	if err != nil {
+		log.Errorf("action: verificar_sorteo | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return c.opError("verificar_sorteo", err)
+	}
+	if !info.Seeded {
+		log.Errorf("action: verificar_sorteo | result: fail | client_id: %v | numero_ganador: %v | error: %v", c.config.ID, info.WinningNumber, ErrDrawNotSeeded)
+		return c.opError("verificar_sorteo", ErrDrawNotSeeded)
+	}
+
+	commitment := c.config.DrawCommitment
+	if commitment == "" {
+		log.Warningf("action: verificar_sorteo | result: in_progress | client_id: %v | error: commitment not configured, using the one reported by the server", c.config.ID)
+		commitment = info.Commitment
+	}
+	if err := lottery.VerifyDraw(commitment, info.Seed, info.WinningNumber); err != nil {
+		log.Criticalf("action: verificar_sorteo | result: fail | client_id: %v | compromiso: %v | semilla: %v | numero_ganador: %v | error: %v",
+			c.config.ID, commitment, info.Seed, info.WinningNumber, err)
+		return c.opError("verificar_sorteo", err)
+	}
+	log.Infof("action: verificar_sorteo | result: success | client_id: %v | compromiso: %v | semilla: %v | numero_ganador: %v",
+		c.config.ID, commitment, info.Seed, info.WinningNumber)
+	return nil
+}
+
+// maxFrameSize Returns the size of the largest frame the client sends and
+// accepts
+func (c *Client) maxFrameSize() int {
+	if c.config.MaxFrameSize <= 0 {
+		return protocol.DefaultMaxFrameSize
+	}
+	return c.config.MaxFrameSize
+}
+
+// agency Returns the client ID as the agency number used by the protocol
+func (c *Client) agency() (int, error) {
+	agency, err := strconv.Atoi(c.config.ID)
+	if err != nil {
+		return 0, errors.Errorf("client id %q is not a valid agency number", c.config.ID)
+	}
+	return agency, nil
+}
+
+// request Sends a frame and returns the response. In per message mode a
+// connection is dialed for every request. In persistent mode the current
+// connection is reused and only dialed again after an error. Since every
+// request waits for its response, requests reach the server in order.
+// No request is sent once ctx is done
+func (c *Client) request(ctx context.Context, request protocol.Frame) (protocol.Frame, error) {
+	if err := ctx.Err(); err != nil {
+		return protocol.Frame{}, err
+	}
+	if c.conn != nil && c.config.IdleTimeout > 0 && time.Since(c.lastUsed) > c.config.IdleTimeout {
+		log.Debugf("action: connect | result: in_progress | client_id: %v | reason: idle timeout", c.config.ID)
+		c.closeConnection()
+	}
+	reused := c.conn != nil
+	if !reused {
+		if err := c.createClientSocket(ctx); err != nil {
+			return protocol.Frame{}, err
+		}
+	}
+
+	response, written, err := c.exchange(ctx, request)
+	if err != nil && reused && isStaleConnection(err) && (!written || resendable(request)) {
+		// The server closed the reused connection, usually because it was
+		// idle. Unless the request cannot be stored twice, it is sent again
+		// through a new connection
+		log.Debugf("action: reconnect | result: in_progress | client_id: %v | error: %v", c.config.ID, err)
+		c.closeConnection()
+		if err := c.createClientSocket(ctx); err != nil {
+			return protocol.Frame{}, err
+		}
+		response, _, err = c.exchange(ctx, request)
+	}
+
+	if err != nil || c.config.ConnectionMode != ConnectionPersistent {
+		c.closeConnection()
+	}
+	return response, err
+}
+
+// resendable Checks whether a request may reach the server twice without
+// effect: queries, the end of bets notification and sequenced batches,
+// which the server recognizes when they are resent. A request that failed
+// while it was being written never reached the server whole, so it can be
+// resent as well
+func resendable(request protocol.Frame) bool {
+	switch request.Type {
+	case protocol.MsgEcho, protocol.MsgFinished, protocol.MsgWinnersQuery, protocol.MsgDrawQuery:
+		return true
+	case protocol.MsgBatch:
+		session, _, err := protocol.BatchSequence(request)
+		return err == nil && session != 0
+	default:
+		return false
+	}
+}
+
+// closeConnection Closes the current connection, if any
+func (c *Client) closeConnection() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// Close Releases the connection kept by the persistent mode
+func (c *Client) Close() error {
+	return c.closeConnection()
+}
+
+// exchange Sends a frame through the current connection and blocks until
+// the response frame is received. written tells whether the whole request
+// was written before the exchange failed. The write and the read are bounded by
+// WriteTimeout and ReadTimeout and the deadline of ctx, if any, bounds the
+// whole exchange. If ctx is cancelled meanwhile the exchange is given
+// ShutdownGrace to finish before being aborted with ErrAborted
+func (c *Client) exchange(ctx context.Context, request protocol.Frame) (response protocol.Frame, written bool, err error) {
+	limit, _ := ctx.Deadline()
+	deadlines := newDeadlines(c.conn, limit)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			// The connection deadlines already expire the exchange
+			return
+		}
+		grace := time.NewTimer(c.config.ShutdownGrace)
+		defer grace.Stop()
+		select {
+		case <-done:
+		case <-grace.C:
+			deadlines.abort()
+		}
+	}()
+
+	response, written, err = c.roundTrip(deadlines, request)
+	c.lastUsed = time.Now()
+	if err != nil && deadlines.isAborted() {
+		err = errors.Wrap(ErrAborted, err.Error())
+	}
+	return response, written, err
+}
+
+// roundTrip Writes the request frame, sealed with a fresh nonce if frames
+// are authenticated, and reads the response frame. Errors are classified
+// so timeouts can be told apart from closed connections. written tells
+// whether the whole request was written
+func (c *Client) roundTrip(deadlines *deadlines, request protocol.Frame) (protocol.Frame, bool, error) {
+	request, err := c.seal(request)
+	if err != nil {
+		return protocol.Frame{}, false, err
+	}
+	if err := deadlines.write(c.config.WriteTimeout); err != nil {
+		return protocol.Frame{}, false, err
+	}
+	if err := protocol.NewWriter(c.conn, c.config.MaxFrameSize).WriteFrame(request); err != nil {
+		return protocol.Frame{}, false, classifyNetError(err, ErrWriteTimeout)
+	}
+
+	if err := deadlines.read(c.config.ReadTimeout); err != nil {
+		return protocol.Frame{}, true, err
+	}
+	response, err := protocol.NewReader(c.conn, c.config.MaxFrameSize).ReadFrame()
+	if err != nil {
+		return protocol.Frame{}, true, classifyNetError(err, ErrReadTimeout)
+	}
+	return response, true, c.checkAuthentication(response)
 }
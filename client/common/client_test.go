@@ -0,0 +1,153 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// fakeServer Answers the requests of the client like the lottery server,
+// except for the batches whose sequence number is in reject, which are
+// rejected. The type of every request received is recorded
+type fakeServer struct {
+	listener net.Listener
+	reject   map[uint32]bool
+
+	mu       sync.Mutex
+	requests []protocol.MessageType
+}
+
+func newFakeServer(t *testing.T, reject ...uint32) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{listener: listener, reject: make(map[uint32]bool)}
+	for _, sequence := range reject {
+		s.reject[sequence] = true
+	}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			reader := protocol.NewReader(conn, 0)
+			writer := protocol.NewWriter(conn, 0)
+			for {
+				request, err := reader.ReadFrame()
+				if err != nil {
+					return
+				}
+				if err := writer.WriteFrame(s.answer(request)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (s *fakeServer) answer(request protocol.Frame) protocol.Frame {
+	s.mu.Lock()
+	s.requests = append(s.requests, request.Type)
+	s.mu.Unlock()
+
+	switch request.Type {
+	case protocol.MsgDrawQuery:
+		f, _ := protocol.EncodeDraw(protocol.DrawInfo{Commitment: "abcd"})
+		return f
+	case protocol.MsgBatch:
+		count, _ := protocol.BatchLen(request)
+		_, sequence, _ := protocol.BatchSequence(request)
+		if s.reject[sequence] {
+			return protocol.EncodeAck(protocol.Ack{Code: protocol.AckInvalidBet, Count: uint32(count)})
+		}
+		return protocol.EncodeAck(protocol.Ack{Code: protocol.AckSuccess, Count: uint32(count)})
+	case protocol.MsgWinnersQuery:
+		query, _ := protocol.DecodeWinnersQuery(request)
+		f, _ := protocol.EncodeWinners(protocol.WinnersResponse{Agency: query.Agency, DrawID: "abcd"}, 0, query.MaxFrameSize)
+		return f
+	default:
+		return protocol.EncodeAck(protocol.Ack{Code: protocol.AckSuccess})
+	}
+}
+
+// received Checks whether a request of the given type was received
+func (s *fakeServer) received(messageType protocol.MessageType) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, request := range s.requests {
+		if request == messageType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDataset Writes a plain CSV dataset with the given amount of rows.
+// The number of each bet is its row, starting at 0
+func writeDataset(t *testing.T, rows int) string {
+	path := filepath.Join(t.TempDir(), "agency-1.csv")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for i := 0; i < rows; i++ {
+		if _, err := fmt.Fprintf(file, "Santiago Lionel,Lorca,30904465,1999-03-17,%d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestSubmitDatasetRejectPolicy(t *testing.T) {
+	tests := []struct {
+		policy   RejectPolicy
+		want     error
+		finished bool
+	}{
+		{RejectStop, ErrBatchRejected, false},
+		{RejectContinue, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			server := newFakeServer(t, 2)
+			client := NewClient(ClientConfig{
+				ID:             "1",
+				ServerAddress:  server.listener.Addr().String(),
+				Mode:           ModeBatch,
+				DatasetPath:    writeDataset(t, 5),
+				BatchMaxAmount: 1,
+				OnReject:       test.policy,
+			})
+			defer client.Close()
+
+			err := client.Run(context.Background())
+			if !errors.Is(err, test.want) {
+				t.Fatalf("Run = %v, want %v", err, test.want)
+			}
+			if got := server.received(protocol.MsgFinished); got != test.finished {
+				t.Errorf("end of bets notified: %v, want %v", got, test.finished)
+			}
+			if got := server.received(protocol.MsgWinnersQuery); got != test.finished {
+				t.Errorf("winners queried: %v, want %v", got, test.finished)
+			}
+		})
+	}
+}
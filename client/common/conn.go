@@ -0,0 +1,144 @@
+package common
+
+import (
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrReadTimeout The server accepted the message but did not answer
+	// within the read timeout. Usually a stuck or busy server
+	ErrReadTimeout = errors.New("read timeout")
+	// ErrWriteTimeout The message could not be written within the write timeout
+	ErrWriteTimeout = errors.New("write timeout")
+	// ErrConnectionClosed The server closed or reset the connection. Usually
+	// a dead server
+	ErrConnectionClosed = errors.New("connection closed by server")
+)
+
+// NetError Error of an exchange classified by Kind, one of ErrReadTimeout,
+// ErrWriteTimeout or ErrConnectionClosed. errors.Is matches both the kind
+// and the underlying error
+type NetError struct {
+	Kind error
+	Err  error
+}
+
+func (e *NetError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap Returns the underlying error
+func (e *NetError) Unwrap() error {
+	return e.Err
+}
+
+// Is Reports whether target is the kind of the error
+func (e *NetError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// classifyNetError Wraps err in a *NetError if it is a timeout or a closed
+// connection. timeoutKind is the kind used for timeouts
+func classifyNetError(err error, timeoutKind error) error {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return &NetError{Kind: timeoutKind, Err: err}
+	case isStaleConnection(err) || err == io.ErrUnexpectedEOF:
+		return &NetError{Kind: ErrConnectionClosed, Err: err}
+	default:
+		return err
+	}
+}
+
+// isStaleConnection Tells whether an exchange failed because the peer had
+// already closed the connection before answering anything
+func isStaleConnection(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// errorKind Short name of the kind of an exchange error to be used in logs
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrAborted):
+		return "aborted"
+	case errors.Is(err, ErrReadTimeout):
+		return "read_timeout"
+	case errors.Is(err, ErrWriteTimeout):
+		return "write_timeout"
+	case errors.Is(err, ErrConnectionClosed):
+		return "connection_closed"
+	case errors.Is(err, ErrAuthenticationFailed):
+		return "authentication_failed"
+	default:
+		return "other"
+	}
+}
+
+// deadlines Sets the deadlines of a connection during a single exchange.
+// Every deadline is bounded by the deadline of the context of the exchange.
+// Once abort is called the connection stays expired
+type deadlines struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	limit   time.Time
+	aborted bool
+}
+
+func newDeadlines(conn net.Conn, limit time.Time) *deadlines {
+	return &deadlines{conn: conn, limit: limit}
+}
+
+// write Sets the write deadline timeout from now. A non positive timeout
+// only applies the context deadline
+func (d *deadlines) write(timeout time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.aborted {
+		return nil
+	}
+	return d.conn.SetWriteDeadline(d.after(timeout))
+}
+
+// read Sets the read deadline timeout from now. A non positive timeout
+// only applies the context deadline
+func (d *deadlines) read(timeout time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.aborted {
+		return nil
+	}
+	return d.conn.SetReadDeadline(d.after(timeout))
+}
+
+func (d *deadlines) after(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return d.limit
+	}
+	deadline := time.Now().Add(timeout)
+	if !d.limit.IsZero() && d.limit.Before(deadline) {
+		return d.limit
+	}
+	return deadline
+}
+
+// abort Expires the connection, interrupting any blocked read or write
+func (d *deadlines) abort() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.aborted = true
+	d.conn.SetDeadline(time.Now())
+}
+
+// isAborted Tells whether abort was called
+func (d *deadlines) isAborted() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.aborted
+}
@@ -0,0 +1,187 @@
+package common
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+)
+
+// zipPrefix Dataset paths starting with this prefix are read from an entry
+// of a zip archive instead of a plain CSV file
+const zipPrefix = "zip:"
+
+// datasetFields Amount of columns of every dataset row: first name, last
+// name, document, birthdate and number
+const datasetFields = 5
+
+// DatasetError Error found while reading a dataset, located by file name
+// and line number
+type DatasetError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *DatasetError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+// Unwrap Returns the underlying error
+func (e *DatasetError) Unwrap() error {
+	return e.Err
+}
+
+// DatasetReader Streams the bets of an agency dataset row by row, so the
+// file is never fully loaded in memory
+type DatasetReader struct {
+	name        string
+	agency      int
+	fingerprint string
+	reader      *csv.Reader
+	closers     []io.Closer
+}
+
+// OpenDataset Opens the dataset of the given agency. path can be a plain
+// CSV file or an entry of a zip archive with the format
+// zip:<archive>#<entry>. If the entry is omitted, agency-<agency>.csv is used
+func OpenDataset(path string, agency int) (*DatasetReader, error) {
+	if !strings.HasPrefix(path, zipPrefix) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		fingerprint, err := hashFile(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return newDatasetReader(filepath.Base(path), agency, fingerprint, file, file), nil
+	}
+
+	archivePath := strings.TrimPrefix(path, zipPrefix)
+	entryName := "agency-" + strconv.Itoa(agency) + ".csv"
+	if i := strings.LastIndex(archivePath, "#"); i >= 0 {
+		archivePath, entryName = archivePath[:i], archivePath[i+1:]
+	}
+
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range archive.File {
+		if entry.Name != entryName {
+			continue
+		}
+		content, err := entry.Open()
+		if err != nil {
+			archive.Close()
+			return nil, err
+		}
+		// The archive already stores the checksum and size of every entry
+		fingerprint := fmt.Sprintf("crc32:%08x:%d", entry.CRC32, entry.UncompressedSize64)
+		return newDatasetReader(entryName, agency, fingerprint, content, content, archive), nil
+	}
+
+	archive.Close()
+	return nil, errors.Errorf("entry %s not found in %s", entryName, archivePath)
+}
+
+// hashFile Returns the SHA-256 of the content of the file, leaving its
+// offset back at the start
+func hashFile(file *os.File) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func newDatasetReader(name string, agency int, fingerprint string, r io.Reader, closers ...io.Closer) *DatasetReader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = datasetFields
+	reader.ReuseRecord = true
+	return &DatasetReader{
+		name:        name,
+		agency:      agency,
+		fingerprint: fingerprint,
+		reader:      reader,
+		closers:     closers,
+	}
+}
+
+// Name Returns the name of the file the bets are read from
+func (r *DatasetReader) Name() string {
+	return r.name
+}
+
+// Fingerprint Returns a checksum of the content of the dataset, so that a
+// modified or replaced dataset can be told apart from the original one
+func (r *DatasetReader) Fingerprint() string {
+	return r.fingerprint
+}
+
+// Next Returns the bet of the next row of the dataset. Rows that cannot be
+// parsed are reported with a *DatasetError. io.EOF is returned at the end
+// of the dataset
+func (r *DatasetReader) Next() (lottery.Bet, error) {
+	record, err := r.reader.Read()
+	if err == io.EOF {
+		return lottery.Bet{}, io.EOF
+	}
+	if err != nil {
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			return lottery.Bet{}, &DatasetError{File: r.name, Line: parseErr.Line, Err: parseErr.Err}
+		}
+		return lottery.Bet{}, err
+	}
+
+	bet, err := lottery.NewBet(strconv.Itoa(r.agency), record[0], record[1], record[2], record[3], record[4])
+	if err != nil {
+		line, _ := r.reader.FieldPos(0)
+		return lottery.Bet{}, &DatasetError{File: r.name, Line: line, Err: err}
+	}
+	return bet, nil
+}
+
+// Skip Discards the next rows of the dataset without parsing them. Fails
+// if the dataset ends before
+func (r *DatasetReader) Skip(rows int) error {
+	for i := 0; i < rows; i++ {
+		if _, err := r.reader.Read(); err != nil {
+			if err == io.EOF {
+				return errors.Errorf("%s has only %d rows, expected at least %d", r.name, i, rows)
+			}
+			if parseErr, ok := err.(*csv.ParseError); ok {
+				return &DatasetError{File: r.name, Line: parseErr.Line, Err: parseErr.Err}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Close Releases the dataset file and, if it was read from a zip archive,
+// the archive itself
+func (r *DatasetReader) Close() error {
+	var firstErr error
+	for _, closer := range r.closers {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
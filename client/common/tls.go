@@ -0,0 +1,82 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// TLSConfig Files and names used to secure the connection to the server
+type TLSConfig struct {
+	Enabled bool
+	// CAFile PEM bundle of the authorities trusted to sign the certificate
+	// of the server. Empty uses the system ones
+	CAFile string
+	// ServerName Name checked against the certificate of the server. Empty
+	// uses the host of the server address
+	ServerName string
+	// CertFile and KeyFile Certificate presented to the server to
+	// authenticate the agency. Empty presents none
+	CertFile string
+	KeyFile  string
+}
+
+// LoadTLSConfig Builds the TLS configuration of the client. Returns nil if
+// TLS is not enabled
+func LoadTLSConfig(config TLSConfig) (*tls.Config, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName: config.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if config.CAFile != "" {
+		pool, err := loadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load certificate %v", config.CertFile)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool Reads the PEM encoded certificates of the file
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read CA file %v", path)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no certificates found in %v", path)
+	}
+	return pool, nil
+}
+
+// contextDialer Dials connections that can be cancelled with a context.
+// Implemented by net.Dialer and tls.Dialer
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// dialer Returns the dialer of the client connections, which completes the
+// TLS handshake before returning if TLS is configured
+func (c *Client) dialer() contextDialer {
+	dialer := &net.Dialer{Timeout: c.config.ConnectTimeout}
+	if c.config.TLS == nil {
+		return dialer
+	}
+	return &tls.Dialer{NetDialer: dialer, Config: c.config.TLS}
+}
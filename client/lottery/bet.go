@@ -0,0 +1,109 @@
+package lottery
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BirthdateLayout Format in which birthdates are parsed and serialized
+const BirthdateLayout = "2006-01-02"
+
+var (
+	// ErrInvalidAgency Returned when the agency is not an integer
+	ErrInvalidAgency = errors.New("agency must be an integer")
+	// ErrInvalidNumber Returned when the bet number is not an integer
+	ErrInvalidNumber = errors.New("number must be an integer")
+	// ErrInvalidBirthdate Returned when the birthdate is not a valid YYYY-MM-DD date
+	ErrInvalidBirthdate = errors.New("birthdate must have YYYY-MM-DD format")
+	// ErrMissingField Returned when a name or the document is empty
+	ErrMissingField = errors.New("missing required field")
+)
+
+// Bet A lottery bet registry. Mirrors the Bet class used by the server
+type Bet struct {
+	Agency    int
+	FirstName string
+	LastName  string
+	Document  string
+	Birthdate time.Time
+	Number    int
+}
+
+// NewBet Builds a bet from its string representation. agency and number
+// must be passed with integer format and birthdate with format YYYY-MM-DD.
+// If some field cannot be parsed the matching ErrInvalid* or ErrMissingField
+// error is returned
+func NewBet(agency, firstName, lastName, document, birthdate, number string) (Bet, error) {
+	bet, err := ParseBet(agency, firstName, lastName, document, birthdate, number)
+	if err != nil {
+		return Bet{}, err
+	}
+	if err := bet.Validate(); err != nil {
+		return Bet{}, err
+	}
+	return bet, nil
+}
+
+// ParseBet Builds a bet from its string representation like NewBet, but
+// accepts empty names and document, as the Bet class of the server does.
+// Meant for bets already stored, which the server may have written
+func ParseBet(agency, firstName, lastName, document, birthdate, number string) (Bet, error) {
+	agencyValue, err := strconv.Atoi(strings.TrimSpace(agency))
+	if err != nil {
+		return Bet{}, errors.Wrapf(ErrInvalidAgency, "agency %q", agency)
+	}
+
+	birthdateValue, err := ParseBirthdate(birthdate)
+	if err != nil {
+		return Bet{}, err
+	}
+
+	numberValue, err := strconv.Atoi(strings.TrimSpace(number))
+	if err != nil {
+		return Bet{}, errors.Wrapf(ErrInvalidNumber, "number %q", number)
+	}
+
+	return Bet{
+		Agency:    agencyValue,
+		FirstName: firstName,
+		LastName:  lastName,
+		Document:  document,
+		Birthdate: birthdateValue,
+		Number:    numberValue,
+	}, nil
+}
+
+// ParseBirthdate Parses a date with ISO format YYYY-MM-DD
+func ParseBirthdate(birthdate string) (time.Time, error) {
+	date, err := time.Parse(BirthdateLayout, birthdate)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(ErrInvalidBirthdate, "birthdate %q", birthdate)
+	}
+	return date, nil
+}
+
+// Validate Checks the fields that cannot be enforced by the types
+// themselves. Bets should be validated before being sent to the server
+func (b Bet) Validate() error {
+	if b.FirstName == "" {
+		return errors.Wrap(ErrMissingField, "first_name")
+	}
+	if b.LastName == "" {
+		return errors.Wrap(ErrMissingField, "last_name")
+	}
+	if b.Document == "" {
+		return errors.Wrap(ErrMissingField, "document")
+	}
+	if b.Birthdate.IsZero() {
+		return errors.Wrap(ErrInvalidBirthdate, "birthdate")
+	}
+	return nil
+}
+
+// BirthdateString Returns the birthdate with format YYYY-MM-DD
+func (b Bet) BirthdateString() string {
+	return b.Birthdate.Format(BirthdateLayout)
+}
@@ -0,0 +1,67 @@
+package lottery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestNewBet(t *testing.T) {
+	bet, err := NewBet(" 1 ", "Santiago Lionel", "Lorca", "30904465", "1999-03-17", "7574")
+	if err != nil {
+		t.Fatalf("NewBet: %v", err)
+	}
+	want := Bet{
+		Agency:    1,
+		FirstName: "Santiago Lionel",
+		LastName:  "Lorca",
+		Document:  "30904465",
+		Birthdate: time.Date(1999, time.March, 17, 0, 0, 0, 0, time.UTC),
+		Number:    7574,
+	}
+	if bet != want {
+		t.Errorf("NewBet = %+v, want %+v", bet, want)
+	}
+	if got := bet.BirthdateString(); got != "1999-03-17" {
+		t.Errorf("BirthdateString = %q, want 1999-03-17", got)
+	}
+}
+
+func TestNewBetErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields [6]string
+		want   error
+	}{
+		{"agency not a number", [6]string{"uno", "A", "B", "1", "1999-03-17", "1"}, ErrInvalidAgency},
+		{"empty agency", [6]string{"", "A", "B", "1", "1999-03-17", "1"}, ErrInvalidAgency},
+		{"number not a number", [6]string{"1", "A", "B", "1", "1999-03-17", "7a"}, ErrInvalidNumber},
+		{"birthdate with another format", [6]string{"1", "A", "B", "1", "17/03/1999", "1"}, ErrInvalidBirthdate},
+		{"impossible birthdate", [6]string{"1", "A", "B", "1", "1999-02-30", "1"}, ErrInvalidBirthdate},
+		{"missing first name", [6]string{"1", "", "B", "1", "1999-03-17", "1"}, ErrMissingField},
+		{"missing last name", [6]string{"1", "A", "", "1", "1999-03-17", "1"}, ErrMissingField},
+		{"missing document", [6]string{"1", "A", "B", "", "1999-03-17", "1"}, ErrMissingField},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := test.fields
+			if _, err := NewBet(f[0], f[1], f[2], f[3], f[4], f[5]); !errors.Is(err, test.want) {
+				t.Errorf("NewBet(%q) = %v, want %v", f, err, test.want)
+			}
+		})
+	}
+}
+
+func TestParseBetAcceptsMissingFields(t *testing.T) {
+	bet, err := ParseBet("1", "", "", "", "1999-03-17", "7574")
+	if err != nil {
+		t.Fatalf("ParseBet: %v", err)
+	}
+	if bet.Agency != 1 || bet.Number != 7574 {
+		t.Errorf("ParseBet = %+v", bet)
+	}
+	if _, err := ParseBet("1", "A", "B", "1", "17/03/1999", "1"); !errors.Is(err, ErrInvalidBirthdate) {
+		t.Errorf("ParseBet with another birthdate format = %v, want ErrInvalidBirthdate", err)
+	}
+}
@@ -0,0 +1,70 @@
+package lottery
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SeedSize Length in bytes of the seeds generated for the draw
+const SeedSize = 32
+
+// MaxNumber Bet numbers go from 0 to MaxNumber
+const MaxNumber = 9999
+
+// numberDomain Prefix hashed with the seed to derive the winning number,
+// so that the number is never the commitment itself
+const numberDomain = "lottery-winning-number:"
+
+var (
+	// ErrCommitmentMismatch Returned when the revealed seed is not the one
+	// whose hash was published before the draw
+	ErrCommitmentMismatch = errors.New("seed does not match the commitment")
+	// ErrNumberMismatch Returned when the announced winning number is not
+	// the one derived from the revealed seed
+	ErrNumberMismatch = errors.New("winning number was not derived from the seed")
+)
+
+// NewSeed Generates a random seed for a draw
+func NewSeed() ([]byte, error) {
+	seed := make([]byte, SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, errors.Wrap(err, "generate draw seed")
+	}
+	return seed, nil
+}
+
+// Commitment Hex encoded SHA-256 of the seed. It is published before the
+// bets close so that the seed, revealed after the draw, cannot be changed
+func Commitment(seed []byte) string {
+	sum := sha256.Sum256(seed)
+	return hex.EncodeToString(sum[:])
+}
+
+// WinningNumber Derives the winning number of the draw from its seed
+func WinningNumber(seed []byte) int {
+	sum := sha256.Sum256(append([]byte(numberDomain), seed...))
+	return int(binary.BigEndian.Uint64(sum[:8]) % (MaxNumber + 1))
+}
+
+// VerifyDraw Checks that the hex encoded seed matches the commitment and
+// that the winning number was derived from it
+func VerifyDraw(commitment string, seedHex string, number int) error {
+	commitment = strings.ToLower(strings.TrimSpace(commitment))
+	seed, err := hex.DecodeString(seedHex)
+	if err != nil {
+		return errors.Wrap(err, "decode seed")
+	}
+	if subtle.ConstantTimeCompare([]byte(Commitment(seed)), []byte(commitment)) != 1 {
+		return errors.Wrapf(ErrCommitmentMismatch, "commitment %v", commitment)
+	}
+	if expected := WinningNumber(seed); expected != number {
+		return errors.Wrapf(ErrNumberMismatch, "announced %d, derived %d", number, expected)
+	}
+	return nil
+}
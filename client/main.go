@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/op/go-logging"
@@ -11,6 +15,8 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
 )
 
 var log = logging.MustGetLogger("log")
@@ -37,6 +43,44 @@ func InitConfig() (*viper.Viper, error) {
 	v.BindEnv("loop", "period")
 	v.BindEnv("loop", "amount")
 	v.BindEnv("log", "level")
+	v.BindEnv("protocol", "maxFrameSize")
+	v.BindEnv("mode")
+	v.BindEnv("batch", "maxAmount")
+	v.BindEnv("batch", "maxBytes")
+	v.BindEnv("batch", "onReject")
+	v.BindEnv("batch", "retries")
+	v.BindEnv("batch", "backoff")
+	v.BindEnv("batch", "maxBackoff")
+	v.BindEnv("dataset", "path")
+	v.BindEnv("checkpoint", "path")
+	v.BindEnv("winners", "retries")
+	v.BindEnv("winners", "backoff")
+	v.BindEnv("winners", "maxBackoff")
+	v.BindEnv("winners", "public_key_file")
+	v.BindEnv("draw", "commitment")
+	v.BindEnv("connection", "mode")
+	v.BindEnv("connect", "retries")
+	v.BindEnv("connect", "backoff")
+	v.BindEnv("connect", "maxBackoff")
+	v.BindEnv("connect", "timeout")
+	v.BindEnv("shutdown", "grace")
+	v.BindEnv("net", "read_timeout")
+	v.BindEnv("net", "write_timeout")
+	v.BindEnv("net", "idle_timeout")
+	v.BindEnv("tls", "enabled")
+	v.BindEnv("tls", "ca_file")
+	v.BindEnv("tls", "server_name")
+	v.BindEnv("tls", "cert_file")
+	v.BindEnv("tls", "key_file")
+	v.BindEnv("auth", "secret")
+	v.BindEnv("auth", "secret_file")
+
+	// Bet fields are read from env variables without the CLI_ prefix
+	v.BindEnv("bet.first_name", "NOMBRE")
+	v.BindEnv("bet.last_name", "APELLIDO")
+	v.BindEnv("bet.document", "DOCUMENTO")
+	v.BindEnv("bet.birthdate", "NACIMIENTO")
+	v.BindEnv("bet.number", "NUMERO")
 
 	// Try to read configuration from config file. If config file
 	// does not exists then ReadInConfig will fail but configuration
@@ -81,11 +125,14 @@ func InitLogger(logLevel string) error {
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
 func PrintConfig(v *viper.Viper) {
-	log.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_amount: %v | loop_period: %v | log_level: %s",
+	log.Infof("action: config | result: success | client_id: %s | mode: %s | server_address: %s | loop_amount: %v | loop_period: %v | batch_max_amount: %v | batch_max_bytes: %v | log_level: %s",
 		v.GetString("id"),
+		v.GetString("mode"),
 		v.GetString("server.address"),
 		v.GetInt("loop.amount"),
 		v.GetDuration("loop.period"),
+		v.GetInt("batch.maxAmount"),
+		v.GetInt("batch.maxBytes"),
 		v.GetString("log.level"),
 	)
 }
@@ -104,12 +151,139 @@ func main() {
 	PrintConfig(v)
 
 	clientConfig := common.ClientConfig{
-		ServerAddress: v.GetString("server.address"),
-		ID:            v.GetString("id"),
-		LoopAmount:    v.GetInt("loop.amount"),
-		LoopPeriod:    v.GetDuration("loop.period"),
+		ServerAddress:     v.GetString("server.address"),
+		ID:                v.GetString("id"),
+		Mode:              common.Mode(v.GetString("mode")),
+		LoopAmount:        v.GetInt("loop.amount"),
+		LoopPeriod:        v.GetDuration("loop.period"),
+		MaxFrameSize:      v.GetInt("protocol.maxFrameSize"),
+		DatasetPath:       v.GetString("dataset.path"),
+		CheckpointPath:    v.GetString("checkpoint.path"),
+		BatchMaxAmount:    v.GetInt("batch.maxAmount"),
+		BatchMaxBytes:     v.GetInt("batch.maxBytes"),
+		OnReject:          common.RejectPolicy(v.GetString("batch.onReject")),
+		BatchRetries:      v.GetInt("batch.retries"),
+		BatchBackoff:      v.GetDuration("batch.backoff"),
+		BatchMaxBackoff:   v.GetDuration("batch.maxBackoff"),
+		WinnersRetries:    v.GetInt("winners.retries"),
+		WinnersBackoff:    v.GetDuration("winners.backoff"),
+		WinnersMaxBackoff: v.GetDuration("winners.maxBackoff"),
+		DrawCommitment:    v.GetString("draw.commitment"),
+		ConnectionMode:    common.ConnectionMode(v.GetString("connection.mode")),
+		ConnectRetries:    v.GetInt("connect.retries"),
+		ConnectBackoff:    v.GetDuration("connect.backoff"),
+		ConnectMaxBackoff: v.GetDuration("connect.maxBackoff"),
+		ConnectTimeout:    v.GetDuration("connect.timeout"),
+		ShutdownGrace:     v.GetDuration("shutdown.grace"),
+		ReadTimeout:       v.GetDuration("net.read_timeout"),
+		WriteTimeout:      v.GetDuration("net.write_timeout"),
+		IdleTimeout:       v.GetDuration("net.idle_timeout"),
+	}
+
+	tlsConfig, err := common.LoadTLSConfig(common.TLSConfig{
+		Enabled:    v.GetBool("tls.enabled"),
+		CAFile:     v.GetString("tls.ca_file"),
+		ServerName: v.GetString("tls.server_name"),
+		CertFile:   v.GetString("tls.cert_file"),
+		KeyFile:    v.GetString("tls.key_file"),
+	})
+	if err != nil {
+		log.Criticalf("action: config | result: fail | client_id: %v | key: tls | error: %v", v.GetString("id"), err)
+		os.Exit(exitFailure)
+	}
+	clientConfig.TLS = tlsConfig
+
+	secret, err := common.LoadSecret(v.GetString("auth.secret"), v.GetString("auth.secret_file"))
+	if err != nil {
+		log.Criticalf("action: config | result: fail | client_id: %v | key: auth | error: %v", v.GetString("id"), err)
+		os.Exit(exitFailure)
+	}
+	clientConfig.AuthSecret = secret
+
+	if path := v.GetString("winners.public_key_file"); path != "" {
+		key, err := protocol.LoadVerifyingKey(path)
+		if err != nil {
+			log.Criticalf("action: config | result: fail | client_id: %v | key: winners.public_key_file | error: %v", v.GetString("id"), err)
+			os.Exit(exitFailure)
+		}
+		clientConfig.WinnersPublicKey = key
+	}
+
+	if clientConfig.Mode == common.ModeBet {
+		bet, err := lottery.NewBet(
+			v.GetString("id"),
+			v.GetString("bet.first_name"),
+			v.GetString("bet.last_name"),
+			v.GetString("bet.document"),
+			v.GetString("bet.birthdate"),
+			v.GetString("bet.number"),
+		)
+		if err != nil {
+			log.Criticalf("action: parse_bet | result: fail | client_id: %v | error: %v", v.GetString("id"), err)
+			os.Exit(exitFailure)
+		}
+		clientConfig.Bet = bet
 	}
 
 	client := common.NewClient(clientConfig)
-	client.StartClientLoop()
+	os.Exit(runUntilSignal(clientConfig.ID, client))
+}
+
+// Exit codes of the client
+const (
+	exitSuccess = 0
+	// exitFailure The selected mode failed before finishing
+	exitFailure = 1
+	// exitUncleanShutdown A signal was received and the exchange in progress
+	// had to be aborted or some resource could not be released
+	exitUncleanShutdown = 2
+)
+
+// runUntilSignal Runs the client until it finishes or SIGTERM or SIGINT
+// is received. A signal cancels the context of the client, so no new
+// messages are sent and the exchange in progress is given the shutdown
+// grace period to finish. Returns the exit code of the program
+func runUntilSignal(clientID string, client *common.Client) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Infof("action: shutdown | result: in_progress | client_id: %v | signal: %v", clientID, sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := client.Run(ctx)
+	signaled := ctx.Err() != nil
+	released := closeResource(clientID, "connection", client)
+
+	switch {
+	case signaled && (errors.Is(err, common.ErrAborted) || !released):
+		log.Errorf("action: shutdown | result: fail | client_id: %v", clientID)
+		return exitUncleanShutdown
+	case signaled:
+		log.Infof("action: shutdown | result: success | client_id: %v", clientID)
+		return exitSuccess
+	case err != nil:
+		return exitFailure
+	default:
+		return exitSuccess
+	}
+}
+
+// closeResource Releases a resource logging the result. Returns whether it
+// was released without errors
+func closeResource(clientID string, name string, resource io.Closer) bool {
+	if err := resource.Close(); err != nil {
+		log.Errorf("action: shutdown | result: fail | client_id: %v | resource: %v | error: %v", clientID, name, err)
+		return false
+	}
+	log.Infof("action: shutdown | result: success | client_id: %v | resource: %v", clientID, name)
+	return true
 }
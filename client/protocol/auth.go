@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// authHeaderSize Agency (uint32) and nonce (uint64) that precede the
+// sealed frame in the payload of a MsgAuthenticated
+const authHeaderSize = 4 + 8
+
+// tagSize Length of the HMAC-SHA256 tag that closes a MsgAuthenticated
+const tagSize = sha256.Size
+
+// AuthOverhead Bytes a frame grows when it is sealed with SealFrame
+const AuthOverhead = authHeaderSize + HeaderSize + tagSize
+
+// ErrAuthentication Returned when an authenticated frame cannot be opened
+// because its agency is unknown, its tag is invalid or its nonce was
+// already used
+var ErrAuthentication = errors.New("frame authentication failed")
+
+// Authenticated Frame opened from a MsgAuthenticated together with the
+// agency that sealed it and the nonce it was sealed with
+type Authenticated struct {
+	Agency int
+	Nonce  uint64
+	Frame  Frame
+}
+
+// SealFrame Wraps the frame in a MsgAuthenticated whose payload is the
+// agency, the nonce, the header and payload of the frame and an
+// HMAC-SHA256 tag of all of them keyed with the secret of the agency. The
+// nonce must be greater than every nonce the agency used before
+func SealFrame(secret []byte, agency int, nonce uint64, f Frame) Frame {
+	payload := make([]byte, authHeaderSize+HeaderSize, AuthOverhead+len(f.Payload))
+	binary.BigEndian.PutUint32(payload[0:], uint32(agency))
+	binary.BigEndian.PutUint64(payload[4:], nonce)
+	payload[authHeaderSize] = byte(f.Type)
+	binary.BigEndian.PutUint32(payload[authHeaderSize+1:], uint32(len(f.Payload)))
+	payload = append(payload, f.Payload...)
+	payload = append(payload, frameTag(secret, payload)...)
+	return Frame{Type: MsgAuthenticated, Payload: payload}
+}
+
+// OpenFrame Checks the tag of a MsgAuthenticated with the secret of the
+// agency that sealed it, as returned by secret, and returns the frame it
+// carries. Checking the nonce is left to the caller
+func OpenFrame(f Frame, secret func(agency int) ([]byte, bool)) (Authenticated, error) {
+	if f.Type != MsgAuthenticated {
+		return Authenticated{}, errors.Wrapf(ErrAuthentication, "unauthenticated message of type %d", f.Type)
+	}
+	if len(f.Payload) < AuthOverhead {
+		return Authenticated{}, errors.Wrap(ErrMalformedPayload, "truncated authenticated frame")
+	}
+	sealed := f.Payload[:len(f.Payload)-tagSize]
+	tag := f.Payload[len(f.Payload)-tagSize:]
+
+	agency := int(binary.BigEndian.Uint32(sealed))
+	key, ok := secret(agency)
+	if !ok {
+		return Authenticated{}, errors.Wrapf(ErrAuthentication, "no secret for agency %d", agency)
+	}
+	if !hmac.Equal(tag, frameTag(key, sealed)) {
+		return Authenticated{}, errors.Wrapf(ErrAuthentication, "invalid tag for agency %d", agency)
+	}
+
+	length := binary.BigEndian.Uint32(sealed[authHeaderSize+1:])
+	payload := sealed[authHeaderSize+HeaderSize:]
+	if uint64(length) != uint64(len(payload)) {
+		return Authenticated{}, errors.Wrapf(ErrMalformedPayload, "sealed frame of %d bytes announces %d", len(payload), length)
+	}
+	return Authenticated{
+		Agency: agency,
+		Nonce:  binary.BigEndian.Uint64(sealed[4:]),
+		Frame:  Frame{Type: MessageType(sealed[authHeaderSize]), Payload: payload},
+	}, nil
+}
+
+func frameTag(secret []byte, sealed []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(sealed)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// secrets Secrets of agencies 1 and 2
+func secrets(agency int) ([]byte, bool) {
+	switch agency {
+	case 1:
+		return []byte("secret-1"), true
+	case 2:
+		return []byte("secret-2"), true
+	default:
+		return nil, false
+	}
+}
+
+func TestSealAndOpenFrame(t *testing.T) {
+	frames := []Frame{
+		{Type: MsgDrawQuery},
+		{Type: MsgFinished, Payload: []byte{0, 0, 0, 1}},
+		{Type: MsgBatch, Payload: bytes.Repeat([]byte{7}, 500)},
+	}
+	for _, f := range frames {
+		sealed := SealFrame([]byte("secret-1"), 1, 42, f)
+		if sealed.Size() != f.Size()+AuthOverhead {
+			t.Errorf("sealed frame of %d bytes, want %d", sealed.Size(), f.Size()+AuthOverhead)
+		}
+
+		opened, err := OpenFrame(sealed, secrets)
+		if err != nil {
+			t.Fatalf("OpenFrame(%v): %v", f.Type, err)
+		}
+		if opened.Agency != 1 || opened.Nonce != 42 {
+			t.Errorf("opened agency %d nonce %d, want 1 and 42", opened.Agency, opened.Nonce)
+		}
+		if opened.Frame.Type != f.Type || !bytes.Equal(opened.Frame.Payload, f.Payload) {
+			t.Errorf("opened %v %q, want %v %q", opened.Frame.Type, opened.Frame.Payload, f.Type, f.Payload)
+		}
+	}
+}
+
+func TestOpenFrameRejects(t *testing.T) {
+	inner := Frame{Type: MsgFinished, Payload: []byte{0, 0, 0, 1}}
+	valid := SealFrame([]byte("secret-1"), 1, 42, inner)
+
+	tampered := func(i int) Frame {
+		payload := append([]byte(nil), valid.Payload...)
+		payload[i] ^= 0x01
+		return Frame{Type: MsgAuthenticated, Payload: payload}
+	}
+
+	tests := []struct {
+		name  string
+		frame Frame
+		want  error
+	}{
+		{"unauthenticated frame", inner, ErrAuthentication},
+		{"wrong secret", SealFrame([]byte("secret-2"), 1, 42, inner), ErrAuthentication},
+		{"unknown agency", SealFrame([]byte("secret-1"), 3, 42, inner), ErrAuthentication},
+		{"other agency", tampered(3), ErrAuthentication},
+		{"tampered nonce", tampered(authHeaderSize - 1), ErrAuthentication},
+		{"tampered payload", tampered(authHeaderSize + HeaderSize), ErrAuthentication},
+		{"tampered tag", tampered(len(valid.Payload) - 1), ErrAuthentication},
+		{"truncated", Frame{Type: MsgAuthenticated, Payload: valid.Payload[:AuthOverhead-1]}, ErrMalformedPayload},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := OpenFrame(test.frame, secrets); !errors.Is(err, test.want) {
+				t.Errorf("OpenFrame = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// HeaderSize Amount of bytes used by the frame header: one byte for the
+// message type followed by the payload length as a big endian uint32
+const HeaderSize = 5
+
+// DefaultMaxFrameSize Maximum size (header included) of the frames accepted
+// by readers and writers when no other limit is configured
+const DefaultMaxFrameSize = 8 * 1024
+
+// ErrFrameTooLarge Returned when a frame to be written or read exceeds the
+// maximum frame size configured
+var ErrFrameTooLarge = errors.New("frame exceeds maximum frame size")
+
+// MessageType Identifies the kind of message carried by a frame
+type MessageType uint8
+
+const (
+	// MsgEcho Message whose payload is sent back untouched by the server
+	MsgEcho MessageType = iota + 1
+	// MsgBet Message carrying a single bet to be stored
+	MsgBet
+	// MsgAck Response of the server to a request that stores bets
+	MsgAck
+	// MsgBatch Message carrying several bets to be stored together
+	MsgBatch
+	// MsgFinished Notification of an agency that has sent all its bets
+	MsgFinished
+	// MsgWinnersQuery Request of the winners of an agency
+	MsgWinnersQuery
+	// MsgWinners Response with the documents of the winners of an agency
+	MsgWinners
+	// MsgDrawQuery Request of the commitment of the draw and, once it took
+	// place, of its revealed seed and winning number
+	MsgDrawQuery
+	// MsgDraw Response to MsgDrawQuery
+	MsgDraw
+	// MsgAuthenticated Envelope of a frame sealed with the secret of an
+	// agency. See SealFrame
+	MsgAuthenticated
+)
+
+// Frame Unit of communication between client and server. Every message
+// is sent as a header with its type and payload length followed by the
+// payload itself
+type Frame struct {
+	Type    MessageType
+	Payload []byte
+}
+
+// Size Returns the amount of bytes the frame takes on the wire
+func (f Frame) Size() int {
+	return HeaderSize + len(f.Payload)
+}
+
+// Writer Writes frames to the underlying writer avoiding short-writes
+type Writer struct {
+	w            io.Writer
+	maxFrameSize int
+}
+
+// NewWriter Initializes a frame writer. Frames bigger than maxFrameSize are
+// rejected before anything is written. A non positive maxFrameSize means
+// DefaultMaxFrameSize
+func NewWriter(w io.Writer, maxFrameSize int) *Writer {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	return &Writer{w: w, maxFrameSize: maxFrameSize}
+}
+
+// WriteFrame Serializes the frame and writes it until every byte has been
+// written or an error is found
+func (w *Writer) WriteFrame(f Frame) error {
+	if f.Size() > w.maxFrameSize {
+		return errors.Wrapf(ErrFrameTooLarge, "frame of %d bytes (max %d)", f.Size(), w.maxFrameSize)
+	}
+
+	buf := make([]byte, f.Size())
+	buf[0] = byte(f.Type)
+	binary.BigEndian.PutUint32(buf[1:HeaderSize], uint32(len(f.Payload)))
+	copy(buf[HeaderSize:], f.Payload)
+
+	return writeAll(w.w, buf)
+}
+
+// writeAll Keeps writing until the whole buffer is sent. A writer that
+// returns no error but does not make progress is reported as a short-write
+func writeAll(w io.Writer, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// Reader Reads frames from the underlying reader avoiding short-reads
+type Reader struct {
+	r            io.Reader
+	maxFrameSize int
+}
+
+// NewReader Initializes a frame reader. Frames whose header announces more
+// than maxFrameSize bytes are rejected without reading their payload. A non
+// positive maxFrameSize means DefaultMaxFrameSize
+func NewReader(r io.Reader, maxFrameSize int) *Reader {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	return &Reader{r: r, maxFrameSize: maxFrameSize}
+}
+
+// ReadFrame Blocks until a whole frame is read. io.EOF is returned only if
+// the connection was closed before any byte of the frame arrived, otherwise
+// io.ErrUnexpectedEOF is returned
+func (r *Reader) ReadFrame() (Frame, error) {
+	var header [HeaderSize]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return Frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if uint64(length)+HeaderSize > uint64(r.maxFrameSize) {
+		return Frame{}, errors.Wrapf(ErrFrameTooLarge, "announced payload of %d bytes (max frame %d)", length, r.maxFrameSize)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+
+	return Frame{Type: MessageType(header[0]), Payload: payload}, nil
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/pkg/errors"
+)
+
+// oneByteWriter Accepts at most one byte per call, like a socket under
+// pressure
+type oneByteWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *oneByteWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return w.buf.Write(p[:1])
+}
+
+// stalledWriter Never makes progress and never fails
+type stalledWriter struct{}
+
+func (stalledWriter) Write(p []byte) (int, error) {
+	return 0, nil
+}
+
+func TestFramesSurviveShortWritesAndReads(t *testing.T) {
+	frames := []Frame{
+		{Type: MsgEcho, Payload: []byte("hola")},
+		{Type: MsgFinished, Payload: []byte{0, 0, 0, 1}},
+		{Type: MsgDrawQuery},
+		{Type: MsgBatch, Payload: bytes.Repeat([]byte{0xab}, 1000)},
+	}
+
+	var w oneByteWriter
+	writer := NewWriter(&w, 0)
+	for _, f := range frames {
+		if err := writer.WriteFrame(f); err != nil {
+			t.Fatalf("WriteFrame(%v): %v", f.Type, err)
+		}
+	}
+
+	reader := NewReader(iotest.OneByteReader(&w.buf), 0)
+	for _, want := range frames {
+		got, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		if got.Type != want.Type || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("ReadFrame = %v %q, want %v %q", got.Type, got.Payload, want.Type, want.Payload)
+		}
+	}
+	if _, err := reader.ReadFrame(); err != io.EOF {
+		t.Errorf("ReadFrame after the last frame = %v, want io.EOF", err)
+	}
+}
+
+func TestWriteFrameErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		w       io.Writer
+		max     int
+		frame   Frame
+		want    error
+		written int
+	}{
+		{"stalled writer", stalledWriter{}, 0, Frame{Type: MsgEcho, Payload: []byte("x")}, io.ErrShortWrite, 0},
+		{"frame too large", &bytes.Buffer{}, 10, Frame{Type: MsgEcho, Payload: []byte("123456")}, ErrFrameTooLarge, 0},
+		{"frame of max size", &bytes.Buffer{}, 10, Frame{Type: MsgEcho, Payload: []byte("12345")}, nil, 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := NewWriter(test.w, test.max).WriteFrame(test.frame)
+			if !errors.Is(err, test.want) {
+				t.Fatalf("WriteFrame = %v, want %v", err, test.want)
+			}
+			if buf, ok := test.w.(*bytes.Buffer); ok && buf.Len() != test.written {
+				t.Errorf("wrote %d bytes, want %d", buf.Len(), test.written)
+			}
+		})
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		max   int
+		want  error
+	}{
+		{"closed before the frame", nil, 0, io.EOF},
+		{"truncated header", []byte{byte(MsgEcho), 0, 0}, 0, io.ErrUnexpectedEOF},
+		{"header without payload", []byte{byte(MsgEcho), 0, 0, 0, 4}, 0, io.ErrUnexpectedEOF},
+		{"truncated payload", []byte{byte(MsgEcho), 0, 0, 0, 4, 'h', 'o'}, 0, io.ErrUnexpectedEOF},
+		{"announced length too large", []byte{byte(MsgEcho), 0, 0, 0, 6, 'h'}, 10, ErrFrameTooLarge},
+		{"announced length overflows", []byte{byte(MsgEcho), 0xff, 0xff, 0xff, 0xff}, 0, ErrFrameTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewReader(iotest.OneByteReader(bytes.NewReader(test.input)), test.max).ReadFrame()
+			if !errors.Is(err, test.want) {
+				t.Errorf("ReadFrame = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestReadFrameDoesNotReadOversizedPayload(t *testing.T) {
+	input := bytes.NewReader(append([]byte{byte(MsgEcho), 0, 0, 0, 100}, make([]byte, 100)...))
+	if _, err := NewReader(input, 50).ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("ReadFrame = %v, want ErrFrameTooLarge", err)
+	}
+	if input.Len() != 100 {
+		t.Errorf("%d payload bytes were consumed, want 0", 100-input.Len())
+	}
+}
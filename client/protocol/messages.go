@@ -0,0 +1,658 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+)
+
+var (
+	// ErrMalformedPayload Returned when a payload cannot be decoded as the
+	// message its frame type announces
+	ErrMalformedPayload = errors.New("malformed payload")
+	// ErrUnexpectedMessage Returned when a frame of a different type than
+	// the expected one is received
+	ErrUnexpectedMessage = errors.New("unexpected message type")
+)
+
+// AckCode Result of a request reported by the server
+type AckCode uint8
+
+const (
+	// AckSuccess Every bet of the request was stored
+	AckSuccess AckCode = iota
+	// AckInvalidBet Some bet of the request could not be parsed or validated
+	AckInvalidBet
+	// AckStorageError The bets were valid but could not be persisted
+	AckStorageError
+	// AckMalformedMessage The request could not be decoded
+	AckMalformedMessage
+	// AckDrawPending The winners were requested before the draw took place
+	AckDrawPending
+	// AckAgencyMismatch The request is on behalf of an agency other than
+	// the one authenticated by the client certificate
+	AckAgencyMismatch
+	// AckAuthenticationFailed The request was not sealed with the secret of
+	// its agency or its nonce was already used
+	AckAuthenticationFailed
+	// AckResponseTooLarge The response to the request does not fit in the
+	// maximum frame size
+	AckResponseTooLarge
+)
+
+// String Returns a human readable name of the code to be used in logs
+func (c AckCode) String() string {
+	switch c {
+	case AckSuccess:
+		return "success"
+	case AckInvalidBet:
+		return "invalid_bet"
+	case AckStorageError:
+		return "storage_error"
+	case AckMalformedMessage:
+		return "malformed_message"
+	case AckDrawPending:
+		return "draw_pending"
+	case AckAgencyMismatch:
+		return "agency_mismatch"
+	case AckAuthenticationFailed:
+		return "authentication_failed"
+	case AckResponseTooLarge:
+		return "response_too_large"
+	default:
+		return "unknown(" + strconv.Itoa(int(c)) + ")"
+	}
+}
+
+// Ack Response sent by the server to requests that store bets. Count is
+// the amount of bets of the request the ack refers to
+type Ack struct {
+	Code  AckCode
+	Count uint32
+}
+
+// ackPayloadSize One byte for the code and four for the count
+const ackPayloadSize = 5
+
+// EncodeAck Builds the frame of an ack
+func EncodeAck(ack Ack) Frame {
+	payload := make([]byte, ackPayloadSize)
+	payload[0] = byte(ack.Code)
+	binary.BigEndian.PutUint32(payload[1:], ack.Count)
+	return Frame{Type: MsgAck, Payload: payload}
+}
+
+// DecodeAck Parses an ack frame
+func DecodeAck(f Frame) (Ack, error) {
+	if f.Type != MsgAck {
+		return Ack{}, errors.Wrapf(ErrUnexpectedMessage, "expected ack, got %d", f.Type)
+	}
+	if len(f.Payload) != ackPayloadSize {
+		return Ack{}, errors.Wrap(ErrMalformedPayload, "ack")
+	}
+	return Ack{
+		Code:  AckCode(f.Payload[0]),
+		Count: binary.BigEndian.Uint32(f.Payload[1:]),
+	}, nil
+}
+
+// EncodeBet Builds the frame of a single bet
+func EncodeBet(bet lottery.Bet) (Frame, error) {
+	payload, err := appendBet(nil, bet)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Type: MsgBet, Payload: payload}, nil
+}
+
+// DecodeBet Parses a single bet frame. The bet fields are validated the
+// same way lottery.NewBet does
+func DecodeBet(f Frame) (lottery.Bet, error) {
+	if f.Type != MsgBet {
+		return lottery.Bet{}, errors.Wrapf(ErrUnexpectedMessage, "expected bet, got %d", f.Type)
+	}
+	d := decoder{buf: f.Payload}
+	bet, err := d.bet()
+	if err != nil {
+		return lottery.Bet{}, err
+	}
+	if len(d.buf) != 0 {
+		return lottery.Bet{}, errors.Wrap(ErrMalformedPayload, "trailing bytes after bet")
+	}
+	return bet, nil
+}
+
+// appendBet Serializes a bet as its six fields, each one as a string
+// prefixed by its length as a big endian uint16. The fields keep the same
+// order and text format used by the server's bets storage
+func appendBet(buf []byte, bet lottery.Bet) ([]byte, error) {
+	fields := [...]string{
+		strconv.Itoa(bet.Agency),
+		bet.FirstName,
+		bet.LastName,
+		bet.Document,
+		bet.BirthdateString(),
+		strconv.Itoa(bet.Number),
+	}
+	for _, field := range fields {
+		if len(field) > math.MaxUint16 {
+			return nil, errors.Wrapf(ErrMalformedPayload, "field of %d bytes", len(field))
+		}
+		buf = appendUint16(buf, uint16(len(field)))
+		buf = append(buf, field...)
+	}
+	return buf, nil
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// appendString Appends the string preceded by its length as uint16
+func appendString(buf []byte, s string) ([]byte, error) {
+	if len(s) > math.MaxUint16 {
+		return nil, errors.Wrapf(ErrMalformedPayload, "string of %d bytes", len(s))
+	}
+	buf = appendUint16(buf, uint16(len(s)))
+	return append(buf, s...), nil
+}
+
+// decoder Consumes a payload from its beginning
+type decoder struct {
+	buf []byte
+}
+
+func (d *decoder) uint16() (uint16, error) {
+	if len(d.buf) < 2 {
+		return 0, errors.Wrap(ErrMalformedPayload, "truncated uint16")
+	}
+	v := binary.BigEndian.Uint16(d.buf)
+	d.buf = d.buf[2:]
+	return v, nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	if len(d.buf) < 4 {
+		return 0, errors.Wrap(ErrMalformedPayload, "truncated uint32")
+	}
+	v := binary.BigEndian.Uint32(d.buf)
+	d.buf = d.buf[4:]
+	return v, nil
+}
+
+func (d *decoder) string() (string, error) {
+	length, err := d.uint16()
+	if err != nil {
+		return "", err
+	}
+	if len(d.buf) < int(length) {
+		return "", errors.Wrap(ErrMalformedPayload, "truncated string")
+	}
+	s := string(d.buf[:length])
+	d.buf = d.buf[length:]
+	return s, nil
+}
+
+func (d *decoder) bet() (lottery.Bet, error) {
+	var fields [6]string
+	for i := range fields {
+		field, err := d.string()
+		if err != nil {
+			return lottery.Bet{}, err
+		}
+		fields[i] = field
+	}
+	return lottery.NewBet(fields[0], fields[1], fields[2], fields[3], fields[4], fields[5])
+}
+
+// Batch payloads start with the session ID (uint64) and sequence number
+// (uint32) of the batch followed by the amount of bets (uint32), all of
+// them big endian
+const (
+	batchSessionOffset  = 0
+	batchSequenceOffset = 8
+	batchCountOffset    = 12
+	batchHeaderSize     = 16
+)
+
+// BatchEncoder Incrementally serializes bets into a single batch frame
+type BatchEncoder struct {
+	payload []byte
+	count   int
+}
+
+// NewBatchEncoder Initializes an empty batch encoder
+func NewBatchEncoder() *BatchEncoder {
+	return &BatchEncoder{payload: make([]byte, batchHeaderSize)}
+}
+
+// TryAdd Appends the bet to the batch only if the resulting frame does not
+// exceed maxFrameSize bytes. Returns false and leaves the batch untouched
+// when the bet does not fit
+func (e *BatchEncoder) TryAdd(bet lottery.Bet, maxFrameSize int) (bool, error) {
+	payload, err := appendBet(e.payload, bet)
+	if err != nil {
+		return false, err
+	}
+	if HeaderSize+len(payload) > maxFrameSize {
+		// Drop the bytes of the bet that did not fit
+		e.payload = payload[:len(e.payload)]
+		return false, nil
+	}
+	e.payload = payload
+	e.count++
+	return true, nil
+}
+
+// Len Returns the amount of bets added to the batch
+func (e *BatchEncoder) Len() int {
+	return e.count
+}
+
+// Size Returns the size of the frame the batch would produce
+func (e *BatchEncoder) Size() int {
+	return HeaderSize + len(e.payload)
+}
+
+// Frame Returns the frame of the bets added so far, without session nor
+// sequence number. The encoder must be reset before being reused
+func (e *BatchEncoder) Frame() Frame {
+	binary.BigEndian.PutUint32(e.payload[batchCountOffset:], uint32(e.count))
+	return Frame{Type: MsgBatch, Payload: e.payload}
+}
+
+// SetBatchSequence Stamps the session ID and sequence number in the header
+// of a batch frame. A zero session means the batch is not sequenced, so the
+// server stores it every time it is received
+func SetBatchSequence(f Frame, session uint64, sequence uint32) error {
+	if f.Type != MsgBatch || len(f.Payload) < batchHeaderSize {
+		return errors.Wrap(ErrMalformedPayload, "not a batch frame")
+	}
+	binary.BigEndian.PutUint64(f.Payload[batchSessionOffset:], session)
+	binary.BigEndian.PutUint32(f.Payload[batchSequenceOffset:], sequence)
+	return nil
+}
+
+// BatchSequence Returns the session ID and sequence number of a batch frame
+func BatchSequence(f Frame) (session uint64, sequence uint32, err error) {
+	if f.Type != MsgBatch {
+		return 0, 0, errors.Wrapf(ErrUnexpectedMessage, "expected batch, got %d", f.Type)
+	}
+	if len(f.Payload) < batchHeaderSize {
+		return 0, 0, errors.Wrap(ErrMalformedPayload, "truncated batch header")
+	}
+	session = binary.BigEndian.Uint64(f.Payload[batchSessionOffset:])
+	sequence = binary.BigEndian.Uint32(f.Payload[batchSequenceOffset:])
+	return session, sequence, nil
+}
+
+// Reset Empties the encoder so a new batch can be built
+func (e *BatchEncoder) Reset() {
+	e.payload = make([]byte, batchHeaderSize)
+	e.count = 0
+}
+
+// EncodeBatch Builds the frame of a batch of bets regardless of its size
+func EncodeBatch(bets []lottery.Bet) (Frame, error) {
+	encoder := NewBatchEncoder()
+	for _, bet := range bets {
+		if _, err := encoder.TryAdd(bet, math.MaxInt32); err != nil {
+			return Frame{}, err
+		}
+	}
+	return encoder.Frame(), nil
+}
+
+// DecodeBatch Parses a batch frame. Every bet is validated the same way
+// lottery.NewBet does and the first invalid bet aborts the decoding
+func DecodeBatch(f Frame) ([]lottery.Bet, error) {
+	if f.Type != MsgBatch {
+		return nil, errors.Wrapf(ErrUnexpectedMessage, "expected batch, got %d", f.Type)
+	}
+	if len(f.Payload) < batchHeaderSize {
+		return nil, errors.Wrap(ErrMalformedPayload, "truncated batch header")
+	}
+	count := binary.BigEndian.Uint32(f.Payload[batchCountOffset:])
+	d := decoder{buf: f.Payload[batchHeaderSize:]}
+
+	// Every bet takes at least the six length prefixes, which bounds the
+	// allocation no matter what count the header claims
+	if uint64(count)*12 > uint64(len(d.buf)) {
+		return nil, errors.Wrapf(ErrMalformedPayload, "batch of %d bets in %d bytes", count, len(d.buf))
+	}
+	bets := make([]lottery.Bet, 0, count)
+	for i := uint32(0); i < count; i++ {
+		bet, err := d.bet()
+		if err != nil {
+			return nil, errors.Wrapf(err, "bet %d", i)
+		}
+		bets = append(bets, bet)
+	}
+	if len(d.buf) != 0 {
+		return nil, errors.Wrap(ErrMalformedPayload, "trailing bytes after batch")
+	}
+	return bets, nil
+}
+
+// EncodeFinished Builds the frame that notifies that the agency has sent
+// all its bets
+func EncodeFinished(agency int) Frame {
+	return Frame{Type: MsgFinished, Payload: encodeAgency(agency)}
+}
+
+// DecodeFinished Parses an agency finished notification
+func DecodeFinished(f Frame) (int, error) {
+	return decodeAgency(f, MsgFinished)
+}
+
+// WinnersQuery Request of the winners of an agency. Since they may not fit
+// in a single frame, they are requested in pages: Offset is the position of
+// the first winner requested and MaxFrameSize the size of the largest
+// response frame the client accepts. Zero means DefaultMaxFrameSize
+type WinnersQuery struct {
+	Agency       int
+	Offset       int
+	MaxFrameSize int
+}
+
+// winnersQueryPayloadSize Agency, offset and maximum frame size, each one
+// as a big endian uint32
+const winnersQueryPayloadSize = 12
+
+// EncodeWinnersQuery Builds the frame that requests a page of the winners
+// of the agency
+func EncodeWinnersQuery(query WinnersQuery) Frame {
+	payload := appendUint32(nil, uint32(query.Agency))
+	payload = appendUint32(payload, uint32(query.Offset))
+	payload = appendUint32(payload, uint32(query.MaxFrameSize))
+	return Frame{Type: MsgWinnersQuery, Payload: payload}
+}
+
+// DecodeWinnersQuery Parses a winners query
+func DecodeWinnersQuery(f Frame) (WinnersQuery, error) {
+	if f.Type != MsgWinnersQuery {
+		return WinnersQuery{}, errors.Wrapf(ErrUnexpectedMessage, "expected winners query, got %d", f.Type)
+	}
+	if len(f.Payload) != winnersQueryPayloadSize {
+		return WinnersQuery{}, errors.Wrap(ErrMalformedPayload, "winners query")
+	}
+	return WinnersQuery{
+		Agency:       int(binary.BigEndian.Uint32(f.Payload)),
+		Offset:       int(binary.BigEndian.Uint32(f.Payload[4:])),
+		MaxFrameSize: int(binary.BigEndian.Uint32(f.Payload[8:])),
+	}, nil
+}
+
+func encodeAgency(agency int) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(agency))
+	return payload
+}
+
+func decodeAgency(f Frame, expected MessageType) (int, error) {
+	if f.Type != expected {
+		return 0, errors.Wrapf(ErrUnexpectedMessage, "expected %d, got %d", expected, f.Type)
+	}
+	if len(f.Payload) != 4 {
+		return 0, errors.Wrap(ErrMalformedPayload, "agency")
+	}
+	return int(binary.BigEndian.Uint32(f.Payload)), nil
+}
+
+// Winner Document of a winning bet and the prize tier it won
+type Winner struct {
+	Document string `json:"document"`
+	Tier     string `json:"tier"`
+}
+
+// WinnersResponse Winners of an agency in a draw. DrawID identifies the
+// draw and Signature, empty if the server does not sign its responses,
+// covers every other field. See SignWinners
+type WinnersResponse struct {
+	Agency        int
+	DrawID        string
+	WinningNumber int
+	Winners       []Winner
+	Signature     []byte
+}
+
+// WinnersPage Part of a winners response sent in a single frame. Winners
+// holds the winners of the page, which start at position Offset out of the
+// Total winners of the agency. The signature covers every winner, so it can
+// only be verified once every page was appended
+type WinnersPage struct {
+	WinnersResponse
+	Offset int
+	Total  int
+}
+
+// Complete Checks whether the page holds every winner of the agency
+func (p WinnersPage) Complete() bool {
+	return p.Offset == 0 && len(p.Winners) == p.Total
+}
+
+// Append Adds the winners of the page that follows p. The next page must be
+// of the same response and start right after the last winner of p
+func (p *WinnersPage) Append(next WinnersPage) error {
+	if next.Agency != p.Agency || next.DrawID != p.DrawID || next.WinningNumber != p.WinningNumber ||
+		next.Total != p.Total || !bytes.Equal(next.Signature, p.Signature) {
+		return errors.Wrap(ErrMalformedPayload, "winners page of another response")
+	}
+	if next.Offset != p.Offset+len(p.Winners) || len(next.Winners) == 0 {
+		return errors.Wrapf(ErrMalformedPayload, "winners page at %d with %d winners, expected it at %d", next.Offset, len(next.Winners), p.Offset+len(p.Winners))
+	}
+	p.Winners = append(p.Winners, next.Winners...)
+	return nil
+}
+
+// EncodeWinners Builds the frame with the page of the winners of an agency
+// that starts at offset and takes as many winners as fit in maxFrameSize
+// bytes. A non positive maxFrameSize means DefaultMaxFrameSize. Every page
+// carries the signature of the whole response. ErrFrameTooLarge is returned
+// if not even one of the remaining winners fits
+func EncodeWinners(response WinnersResponse, offset int, maxFrameSize int) (Frame, error) {
+	if offset < 0 || offset > len(response.Winners) {
+		return Frame{}, errors.Wrapf(ErrMalformedPayload, "winners offset %d of %d", offset, len(response.Winners))
+	}
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	if len(response.Signature) > math.MaxUint16 {
+		return Frame{}, errors.Wrapf(ErrMalformedPayload, "signature of %d bytes", len(response.Signature))
+	}
+	// Room left for the winners once the header and the signature are
+	// accounted for
+	budget := maxFrameSize - HeaderSize - 2 - len(response.Signature)
+
+	payload := appendUint32(nil, uint32(response.Agency))
+	payload, err := appendString(payload, response.DrawID)
+	if err != nil {
+		return Frame{}, err
+	}
+	payload = appendUint32(payload, uint32(response.WinningNumber))
+	payload = appendUint32(payload, uint32(len(response.Winners)))
+	payload = appendUint32(payload, uint32(offset))
+	countOffset := len(payload)
+	payload = appendUint32(payload, 0)
+	if len(payload) > budget {
+		return Frame{}, errors.Wrapf(ErrFrameTooLarge, "winners response header (max %d)", maxFrameSize)
+	}
+
+	count := 0
+	for _, winner := range response.Winners[offset:] {
+		next, err := appendString(payload, winner.Document)
+		if err != nil {
+			return Frame{}, err
+		}
+		if next, err = appendString(next, winner.Tier); err != nil {
+			return Frame{}, err
+		}
+		if len(next) > budget {
+			break
+		}
+		payload = next
+		count++
+	}
+	if count == 0 && offset < len(response.Winners) {
+		return Frame{}, errors.Wrapf(ErrFrameTooLarge, "winner %d (max %d)", offset, maxFrameSize)
+	}
+	binary.BigEndian.PutUint32(payload[countOffset:], uint32(count))
+
+	payload, _ = appendString(payload, string(response.Signature))
+	return Frame{Type: MsgWinners, Payload: payload}, nil
+}
+
+// DecodeWinners Parses a page of the winners response
+func DecodeWinners(f Frame) (WinnersPage, error) {
+	if f.Type != MsgWinners {
+		return WinnersPage{}, errors.Wrapf(ErrUnexpectedMessage, "expected winners, got %d", f.Type)
+	}
+	d := decoder{buf: f.Payload}
+	agency, err := d.uint32()
+	if err != nil {
+		return WinnersPage{}, err
+	}
+	drawID, err := d.string()
+	if err != nil {
+		return WinnersPage{}, err
+	}
+	number, err := d.uint32()
+	if err != nil {
+		return WinnersPage{}, err
+	}
+	total, err := d.uint32()
+	if err != nil {
+		return WinnersPage{}, err
+	}
+	offset, err := d.uint32()
+	if err != nil {
+		return WinnersPage{}, err
+	}
+	count, err := d.uint32()
+	if err != nil {
+		return WinnersPage{}, err
+	}
+	if uint64(offset)+uint64(count) > uint64(total) {
+		return WinnersPage{}, errors.Wrapf(ErrMalformedPayload, "winners %d to %d of %d", offset, uint64(offset)+uint64(count), total)
+	}
+	if uint64(count)*4 > uint64(len(d.buf)) {
+		return WinnersPage{}, errors.Wrapf(ErrMalformedPayload, "%d winners in %d bytes", count, len(d.buf))
+	}
+
+	winners := make([]Winner, 0, count)
+	for i := uint32(0); i < count; i++ {
+		document, err := d.string()
+		if err != nil {
+			return WinnersPage{}, err
+		}
+		tier, err := d.string()
+		if err != nil {
+			return WinnersPage{}, err
+		}
+		winners = append(winners, Winner{Document: document, Tier: tier})
+	}
+	signature, err := d.string()
+	if err != nil {
+		return WinnersPage{}, err
+	}
+	if len(d.buf) != 0 {
+		return WinnersPage{}, errors.Wrap(ErrMalformedPayload, "trailing bytes after winners")
+	}
+	return WinnersPage{
+		WinnersResponse: WinnersResponse{
+			Agency:        int(agency),
+			DrawID:        drawID,
+			WinningNumber: int(number),
+			Winners:       winners,
+			Signature:     []byte(signature),
+		},
+		Offset: int(offset),
+		Total:  int(total),
+	}, nil
+}
+
+// DrawInfo Public information of the draw. Commitment is the hash of the
+// seed, published before the bets close. Seed is the hex encoded seed and
+// WinningNumber the number of the draw, both empty until the draw. Seeded
+// tells whether WinningNumber was derived from the seed, otherwise it is a
+// fixed number that cannot be verified against the commitment
+type DrawInfo struct {
+	Commitment    string
+	Seed          string
+	WinningNumber int
+	Seeded        bool
+}
+
+// Revealed Checks whether the seed of the draw was already revealed
+func (i DrawInfo) Revealed() bool {
+	return i.Seed != ""
+}
+
+// EncodeDrawQuery Builds the frame that requests the draw information
+func EncodeDrawQuery() Frame {
+	return Frame{Type: MsgDrawQuery}
+}
+
+// EncodeDraw Builds the frame with the draw information
+func EncodeDraw(info DrawInfo) (Frame, error) {
+	var payload []byte
+	for _, field := range []string{info.Commitment, info.Seed} {
+		if len(field) > math.MaxUint16 {
+			return Frame{}, errors.Wrapf(ErrMalformedPayload, "draw field of %d bytes", len(field))
+		}
+		payload = appendUint16(payload, uint16(len(field)))
+		payload = append(payload, field...)
+	}
+	payload = appendUint32(payload, uint32(info.WinningNumber))
+	var seeded byte
+	if info.Seeded {
+		seeded = 1
+	}
+	return Frame{Type: MsgDraw, Payload: append(payload, seeded)}, nil
+}
+
+// DecodeDraw Parses the draw information response
+func DecodeDraw(f Frame) (DrawInfo, error) {
+	if f.Type != MsgDraw {
+		return DrawInfo{}, errors.Wrapf(ErrUnexpectedMessage, "expected draw, got %d", f.Type)
+	}
+	d := decoder{buf: f.Payload}
+	commitment, err := d.string()
+	if err != nil {
+		return DrawInfo{}, err
+	}
+	seed, err := d.string()
+	if err != nil {
+		return DrawInfo{}, err
+	}
+	if len(d.buf) != 5 || d.buf[4] > 1 {
+		return DrawInfo{}, errors.Wrap(ErrMalformedPayload, "draw winning number")
+	}
+	return DrawInfo{
+		Commitment:    commitment,
+		Seed:          seed,
+		WinningNumber: int(binary.BigEndian.Uint32(d.buf)),
+		Seeded:        d.buf[4] == 1,
+	}, nil
+}
+
+// BatchLen Returns the amount of bets a batch frame claims to carry without
+// decoding them, so that even malformed batches can be acknowledged
+func BatchLen(f Frame) (int, error) {
+	if f.Type != MsgBatch {
+		return 0, errors.Wrapf(ErrUnexpectedMessage, "expected batch, got %d", f.Type)
+	}
+	if len(f.Payload) < batchHeaderSize {
+		return 0, errors.Wrap(ErrMalformedPayload, "truncated batch header")
+	}
+	return int(binary.BigEndian.Uint32(f.Payload[batchCountOffset:])), nil
+}
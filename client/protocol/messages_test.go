@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// manyWinners Response with more winners than fit in a frame of
+// DefaultMaxFrameSize bytes
+func manyWinners(t *testing.T) (WinnersResponse, ed25519.PublicKey) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := WinnersResponse{Agency: 1, DrawID: strings.Repeat("ab", 32), WinningNumber: 4}
+	for i := 0; i < 3000; i++ {
+		response.Winners = append(response.Winners, Winner{Document: fmt.Sprintf("%08d", 30000000+i), Tier: "reintegro"})
+	}
+	SignWinners(private, &response)
+	return response, public
+}
+
+func TestWinnersPages(t *testing.T) {
+	response, public := manyWinners(t)
+
+	var winners WinnersPage
+	pages := 0
+	for pages == 0 || !winners.Complete() {
+		f, err := EncodeWinners(response, len(winners.Winners), DefaultMaxFrameSize)
+		if err != nil {
+			t.Fatalf("EncodeWinners page %d: %v", pages, err)
+		}
+		if f.Size() > DefaultMaxFrameSize {
+			t.Fatalf("page %d of %d bytes, max %d", pages, f.Size(), DefaultMaxFrameSize)
+		}
+		page, err := DecodeWinners(f)
+		if err != nil {
+			t.Fatalf("DecodeWinners page %d: %v", pages, err)
+		}
+		if pages == 0 {
+			winners = page
+		} else if err := winners.Append(page); err != nil {
+			t.Fatalf("Append page %d: %v", pages, err)
+		}
+		pages++
+	}
+
+	if pages < 2 {
+		t.Errorf("%d winners sent in %d page", len(response.Winners), pages)
+	}
+	if !reflect.DeepEqual(winners.WinnersResponse, response) {
+		t.Errorf("reassembled winners differ from the response")
+	}
+	if err := VerifyWinners(public, winners.WinnersResponse); err != nil {
+		t.Errorf("VerifyWinners: %v", err)
+	}
+}
+
+func TestWinnersWithoutWinners(t *testing.T) {
+	f, err := EncodeWinners(WinnersResponse{Agency: 3, DrawID: "abcd"}, 0, DefaultMaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := DecodeWinners(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !page.Complete() || len(page.Winners) != 0 || page.Agency != 3 {
+		t.Errorf("DecodeWinners = %+v, want a complete page of agency 3 without winners", page)
+	}
+}
+
+func TestEncodeWinnersErrors(t *testing.T) {
+	response, _ := manyWinners(t)
+	huge := WinnersResponse{Agency: 1, Winners: []Winner{{Document: strings.Repeat("1", DefaultMaxFrameSize), Tier: "t"}}}
+
+	tests := []struct {
+		name     string
+		response WinnersResponse
+		offset   int
+		want     error
+	}{
+		{"offset after the last winner", response, len(response.Winners) + 1, ErrMalformedPayload},
+		{"negative offset", response, -1, ErrMalformedPayload},
+		{"winner larger than a frame", huge, 0, ErrFrameTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := EncodeWinners(test.response, test.offset, DefaultMaxFrameSize); !errors.Is(err, test.want) {
+				t.Errorf("EncodeWinners = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestWinnersPageAppendRejects(t *testing.T) {
+	response, _ := manyWinners(t)
+	decode := func(offset int) WinnersPage {
+		f, err := EncodeWinners(response, offset, DefaultMaxFrameSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err := DecodeWinners(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+	first := decode(0)
+
+	other := decode(len(first.Winners))
+	other.DrawID = "other"
+	tests := []struct {
+		name string
+		next WinnersPage
+	}{
+		{"same page again", decode(0)},
+		{"page with a gap", decode(len(first.Winners) + 1)},
+		{"page of another draw", other},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page := first
+			page.Winners = append([]Winner(nil), first.Winners...)
+			if err := page.Append(test.next); !errors.Is(err, ErrMalformedPayload) {
+				t.Errorf("Append = %v, want ErrMalformedPayload", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// winnersSignatureDomain Prefix of the signed content of winners responses,
+// so that a signature cannot be reused for any other message
+const winnersSignatureDomain = "lottery-winners-v1\x00"
+
+var (
+	// ErrInvalidSignature Returned when a winners response is not signed by
+	// the expected key
+	ErrInvalidSignature = errors.New("invalid winners signature")
+	// ErrInvalidKey Returned when a key file does not hold an Ed25519 key
+	ErrInvalidKey = errors.New("not an Ed25519 key")
+)
+
+// winnersSignedContent Canonical encoding of what the signature of a
+// winners response covers: agency, draw ID, winning number and the winners
+// sorted by document, each one with its prize tier
+func winnersSignedContent(response WinnersResponse) []byte {
+	winners := make([]Winner, len(response.Winners))
+	copy(winners, response.Winners)
+	sort.Slice(winners, func(i, j int) bool {
+		return winners[i].Document < winners[j].Document
+	})
+
+	content := []byte(winnersSignatureDomain)
+	content = appendUint32(content, uint32(response.Agency))
+	content = appendUint32(content, uint32(len(response.DrawID)))
+	content = append(content, response.DrawID...)
+	content = appendUint32(content, uint32(response.WinningNumber))
+	content = appendUint32(content, uint32(len(winners)))
+	for _, winner := range winners {
+		content = appendUint32(content, uint32(len(winner.Document)))
+		content = append(content, winner.Document...)
+		content = appendUint32(content, uint32(len(winner.Tier)))
+		content = append(content, winner.Tier...)
+	}
+	return content
+}
+
+// SignWinners Sets the signature of the response with the given key
+func SignWinners(key ed25519.PrivateKey, response *WinnersResponse) {
+	response.Signature = ed25519.Sign(key, winnersSignedContent(*response))
+}
+
+// VerifyWinners Checks that the response was signed with the private key
+// of the given public key
+func VerifyWinners(key ed25519.PublicKey, response WinnersResponse) error {
+	if len(response.Signature) == 0 {
+		return errors.Wrap(ErrInvalidSignature, "response is not signed")
+	}
+	if !ed25519.Verify(key, winnersSignedContent(response), response.Signature) {
+		return errors.Wrapf(ErrInvalidSignature, "agency %d, draw %v", response.Agency, response.DrawID)
+	}
+	return nil
+}
+
+// LoadSigningKey Reads an Ed25519 private key from a PEM encoded PKCS #8
+// file, as generated by `openssl genpkey -algorithm ed25519`
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse private key %v", path)
+	}
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Wrapf(ErrInvalidKey, "private key %v", path)
+	}
+	return signingKey, nil
+}
+
+// LoadVerifyingKey Reads an Ed25519 public key from a PEM encoded PKIX
+// file, as generated by `openssl pkey -pubout`
+func LoadVerifyingKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse public key %v", path)
+	}
+	verifyingKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.Wrapf(ErrInvalidKey, "public key %v", path)
+	}
+	return verifyingKey, nil
+}
+
+// readPEM Returns the content of the first PEM block of the file, which
+// must be of the given type
+func readPEM(path string, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read key %v", path)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, errors.Errorf("%v has no %v PEM block", path, blockType)
+	}
+	return block.Bytes, nil
+}
@@ -0,0 +1,158 @@
+// Command gencerts Generates a local certificate authority and the server
+// and agency certificates it signs, for development and testing only.
+//
+//	go run ./goserver/cmd/gencerts -out ./certs -hosts server,localhost,127.0.0.1 -agencies 1,2,3,4,5
+//
+// Writes ca.pem and ca-key.pem, server.pem and server-key.pem, and
+// client-<agency>.pem and client-<agency>-key.pem for every agency. Client
+// certificates have agency-<agency> as common name
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+)
+
+var log = logging.MustGetLogger("log")
+
+// validity Lifetime of the generated certificates
+const validity = 365 * 24 * time.Hour
+
+// issuer Certificate and key that sign other certificates
+type issuer struct {
+	certificate *x509.Certificate
+	key         crypto.Signer
+}
+
+func main() {
+	out := flag.String("out", "./certs", "directory where the files are written")
+	hosts := flag.String("hosts", "server,localhost,127.0.0.1", "comma separated names and IPs of the server certificate")
+	agencies := flag.String("agencies", "1,2,3,4,5", "comma separated agencies that get a client certificate")
+	flag.Parse()
+
+	if err := generate(*out, splitList(*hosts), splitList(*agencies)); err != nil {
+		log.Criticalf("action: gencerts | result: fail | error: %v", err)
+		os.Exit(1)
+	}
+	log.Infof("action: gencerts | result: success | dir: %v", *out)
+}
+
+// generate Writes the CA, the server certificate for hosts and a client
+// certificate for every agency in dir
+func generate(dir string, hosts []string, agencies []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	ca, err := newCertificate(dir, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "lottery local CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	server := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			server.IPAddresses = append(server.IPAddresses, ip)
+		} else {
+			server.DNSNames = append(server.DNSNames, host)
+		}
+	}
+	if _, err := newCertificate(dir, "server", server, ca); err != nil {
+		return err
+	}
+
+	for _, agency := range agencies {
+		_, err := newCertificate(dir, "client-"+agency, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "agency-" + agency},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newCertificate Generates a key, signs template with the issuer, or with
+// the key itself if there is no issuer, and writes both to <name>.pem and
+// <name>-key.pem
+func newCertificate(dir string, name string, template *x509.Certificate, parent *issuer) (*issuer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = template.NotBefore.Add(validity)
+
+	signer := &issuer{certificate: template, key: key}
+	if parent != nil {
+		signer = parent
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.certificate, key.Public(), signer.key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create certificate %v", name)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writePEM(filepath.Join(dir, name+".pem"), "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+	if err := writePEM(filepath.Join(dir, name+"-key.pem"), "PRIVATE KEY", keyDER, 0600); err != nil {
+		return nil, err
+	}
+	log.Infof("action: gencerts | result: in_progress | certificate: %v | subject: %v", name, certificate.Subject.CommonName)
+	return &issuer{certificate: certificate, key: key}, nil
+}
+
+func writePEM(path string, blockType string, der []byte, mode os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	return errors.Wrapf(os.WriteFile(path, data, mode), "write %v", path)
+}
+
+// splitList Splits a comma separated list ignoring empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
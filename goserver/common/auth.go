@@ -0,0 +1,146 @@
+package common
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// errSessionState The state of the sessions could not be persisted, so the
+// request cannot be accepted safely
+var errSessionState = errors.New("session state not persisted")
+
+// LoadSecrets Reads the secret of every agency from the file at path, one
+// <agency>=<secret> per line, and from inline, a comma separated list of
+// <agency>=<secret> items that takes precedence. Lines starting with # are
+// ignored. Both may be empty
+func LoadSecrets(path string, inline string) (map[int][]byte, error) {
+	secrets := make(map[int][]byte)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read secrets file %v", path)
+		}
+		if err := parseSecrets(secrets, strings.Split(string(data), "\n")); err != nil {
+			return nil, errors.Wrapf(err, "secrets file %v", path)
+		}
+	}
+	if err := parseSecrets(secrets, strings.Split(inline, ",")); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+func parseSecrets(secrets map[int][]byte, entries []string) error {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		agency, secret := entry, ""
+		if i := strings.Index(entry, "="); i >= 0 {
+			agency, secret = entry[:i], entry[i+1:]
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(agency))
+		if err != nil || secret == "" {
+			return errors.Errorf("invalid secret entry for agency %q", agency)
+		}
+		secrets[id] = []byte(secret)
+	}
+	return nil
+}
+
+// nonceGuard Remembers the greatest nonce used by each agency so that
+// replayed frames are rejected. If it has a journal, nonces are reserved in
+// blocks: a nonce above the reserved mark of its agency moves the mark
+// reserve nonces beyond it, and the mark is persisted before the nonce is
+// accepted. After a restart every nonce up to the mark is rejected, so
+// frames replayed after a restart are rejected as well, while only one
+// nonce per block pays for an fsync
+type nonceGuard struct {
+	mu   sync.Mutex
+	last map[int]uint64
+	// reserved Greatest nonce of each agency persisted in the journal
+	reserved map[int]uint64
+	// reserve Size of the blocks of nonces reserved with a single fsync.
+	// Clients derive their nonces from the nanoseconds of their clock, so
+	// it is the time a block lasts in nanoseconds
+	reserve uint64
+	journal *sessionJournal
+}
+
+// accept Registers the nonce of the agency. Returns false if it is not
+// greater than every nonce the agency used before, and an error if its
+// reservation could not be persisted
+func (g *nonceGuard) accept(agency int, nonce uint64) (bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if last, ok := g.last[agency]; ok && nonce <= last {
+		return false, nil
+	}
+	g.init()
+	if g.journal != nil && nonce > g.reserved[agency] {
+		mark := nonce + g.reserve
+		if mark < nonce {
+			mark = math.MaxUint64
+		}
+		if err := g.journal.Record([]interface{}{sessionEvent{Kind: eventNonce, Agency: agency, Nonce: mark}}); err != nil {
+			return false, err
+		}
+		g.reserved[agency] = mark
+	}
+	g.last[agency] = nonce
+	return true, nil
+}
+
+// init Creates the maps of the guard on first use
+func (g *nonceGuard) init() {
+	if g.last == nil {
+		g.last = make(map[int]uint64)
+		g.reserved = make(map[int]uint64)
+	}
+}
+
+// restore Registers the reserved mark of the agency persisted in the
+// journal. Every nonce up to it is considered used
+func (g *nonceGuard) restore(agency int, mark uint64) {
+	g.init()
+	if last, ok := g.last[agency]; !ok || mark > last {
+		g.last[agency] = mark
+		g.reserved[agency] = mark
+	}
+}
+
+// secret Returns the secret of the agency
+func (s *Server) secret(agency int) ([]byte, bool) {
+	secret, ok := s.config.AuthSecrets[agency]
+	return secret, ok
+}
+
+// openRequest Checks the tag and nonce of an authenticated request and
+// returns the frame it carries, together with the session restricted to
+// the agency that sealed it
+func (s *Server) openRequest(sess session, request protocol.Frame) (protocol.Frame, session, error) {
+	opened, err := protocol.OpenFrame(request, s.secret)
+	if err != nil {
+		return protocol.Frame{}, sess, err
+	}
+	if !sess.authorizes(opened.Agency) {
+		return protocol.Frame{}, sess, errors.Wrapf(protocol.ErrAuthentication, "frame of agency %d, authenticated as %d", opened.Agency, sess.agency)
+	}
+	accepted, err := s.nonces.accept(opened.Agency, opened.Nonce)
+	if err != nil {
+		return protocol.Frame{}, sess, err
+	}
+	if !accepted {
+		return protocol.Frame{}, sess, errors.Wrapf(protocol.ErrAuthentication, "replayed nonce %d of agency %d", opened.Nonce, opened.Agency)
+	}
+	sess.agency = opened.Agency
+	return opened.Frame, sess, nil
+}
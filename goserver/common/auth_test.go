@@ -0,0 +1,79 @@
+package common
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNonceGuardRejectsReplays(t *testing.T) {
+	var guard nonceGuard
+	steps := []struct {
+		agency   int
+		nonce    uint64
+		accepted bool
+	}{
+		{1, 10, true},
+		{1, 10, false},
+		{1, 9, false},
+		{1, 11, true},
+		{2, 5, true},
+	}
+	for _, step := range steps {
+		accepted, err := guard.accept(step.agency, step.nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accepted != step.accepted {
+			t.Errorf("accept(%d, %d) = %v, want %v", step.agency, step.nonce, accepted, step.accepted)
+		}
+	}
+}
+
+func TestNonceGuardReservesBlocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	guard := nonceGuard{reserve: 100}
+	var batches batchSequencer
+	sessions, err := openSessions(path, &guard, &batches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for nonce := uint64(1); nonce <= 250; nonce++ {
+		if accepted, err := guard.accept(1, nonce); err != nil || !accepted {
+			t.Fatalf("accept(1, %d) = %v, %v", nonce, accepted, err)
+		}
+	}
+	if err := sessions.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocks reserved at nonces 1, 102 and 203
+	if lines := bytes.Count(data, []byte("\n")); lines != 3 {
+		t.Errorf("%d nonces persisted for 250 accepted nonces, want 3", lines)
+	}
+
+	restored := nonceGuard{reserve: 100}
+	sessions, err = openSessions(path, &restored, &batches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.Close()
+	steps := []struct {
+		nonce    uint64
+		accepted bool
+	}{
+		{250, false},
+		{303, false},
+		{304, true},
+	}
+	for _, step := range steps {
+		if accepted, err := restored.accept(1, step.nonce); err != nil || accepted != step.accepted {
+			t.Errorf("accept(1, %d) after a restart = %v, %v, want %v", step.nonce, accepted, err, step.accepted)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package common
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/goserver/storage"
+)
+
+// DrawConfig Decides when the draw takes place
+type DrawConfig struct {
+	// ExpectedAgencies Amount of agencies whose finish triggers the draw
+	ExpectedAgencies int
+	// Deadline Time since the coordinator starts after which the draw runs
+	// with the agencies that finished so far. Zero means no deadline
+	Deadline time.Duration
+	// Quorum Minimum amount of finished agencies needed to run the draw
+	// when the deadline expires. Zero means at least one agency
+	Quorum int
+	// StatePath Journal where the progress of the draw is persisted so it
+	// survives restarts. Empty keeps it in memory only
+	StatePath string
+	// Prizes Rules that decide the prize tier of each bet, from the highest
+	// prize to the lowest. Empty awards only the bets of the winning number
+	Prizes []PrizeConfig
+	// Seeded Derives the winning number from the committed seed of the
+	// draw. Otherwise the winning number is LotteryWinnerNumber
+	Seeded bool
+}
+
+// Kinds of the events stored in the draw state journal
+const (
+	eventCommitted = "committed"
+	eventFinished  = "finished"
+	eventDrawn     = "drawn"
+)
+
+// drawEvent Record of the draw state journal. A committed event carries the
+// seed of the draw, a finished event the agency that finished and a drawn
+// event the winning number, whether it was derived from the seed, the
+// agencies that took part in the draw and the winners of each one
+type drawEvent struct {
+	Kind          string                    `json:"event"`
+	Seed          string                    `json:"seed,omitempty"`
+	Agency        int                       `json:"agency,omitempty"`
+	WinningNumber *int                      `json:"winning_number,omitempty"`
+	Seeded        bool                      `json:"seeded,omitempty"`
+	Participants  []int                     `json:"participants,omitempty"`
+	Winners       map[int][]protocol.Winner `json:"winners,omitempty"`
+}
+
+// DrawCoordinator Keeps track of the agencies that finished sending their
+// bets and runs the draw once every expected agency finished or, if a
+// deadline is configured, once it expires and the quorum is reached. Only
+// the bets of the agencies that finished before the draw take part in it.
+// The coordinator commits to a random seed when it is created by publishing
+// its hash, and reveals the seed once the draw took place.
+// The progress is persisted in a journal before it is acknowledged, so a
+// restarted coordinator resumes where the previous one stopped. Safe to use
+// from several goroutines
+type DrawCoordinator struct {
+	config  DrawConfig
+	store   *storage.Store
+	journal *storage.Journal
+	// seed Secret of the draw until it takes place. Its hash is the
+	// commitment published before the bets close
+	seed []byte
+
+	mu              sync.Mutex
+	finished        map[int]bool
+	deadlineExpired bool
+	deadline        *time.Timer
+	drawn           bool
+	winningNumber   int
+	seeded          bool
+	participants    map[int]bool
+	winners         map[int][]protocol.Winner
+}
+
+// NewDrawCoordinator Initializes a coordinator, restores the state stored
+// in its journal, commits to the seed of the draw and starts its deadline,
+// if any. The deadline counts from the moment the coordinator is created,
+// also after a restart. At least one agency must be expected and the quorum
+// cannot exceed the expected agencies
+func NewDrawCoordinator(store *storage.Store, config DrawConfig) (*DrawCoordinator, error) {
+	if config.ExpectedAgencies < 1 {
+		return nil, errors.Errorf("draw expects %d agencies, at least 1 is required", config.ExpectedAgencies)
+	}
+	if config.Quorum < 0 || config.Quorum > config.ExpectedAgencies {
+		return nil, errors.Errorf("draw quorum %d is not between 0 and the %d expected agencies", config.Quorum, config.ExpectedAgencies)
+	}
+	if _, err := NewWinnersEngineFromConfig(config.Prizes, LotteryWinnerNumber); err != nil {
+		return nil, err
+	}
+	d := &DrawCoordinator{
+		config:   config,
+		store:    store,
+		finished: make(map[int]bool),
+		winners:  make(map[int][]protocol.Winner),
+	}
+	if config.StatePath != "" {
+		journal, err := storage.OpenJournal(config.StatePath, d.restore)
+		if err != nil {
+			return nil, err
+		}
+		d.journal = journal
+		log.Infof("action: restaurar_sorteo | result: success | finalizadas: %v | sorteo_realizado: %v", len(d.finished), d.drawn)
+	}
+
+	d.mu.Lock()
+	err := d.commit()
+	if err == nil {
+		// Every agency may have finished before a crash prevented the draw
+		err = d.drawIfReady()
+	}
+	d.mu.Unlock()
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	if config.Deadline > 0 && !d.drawn {
+		d.deadline = time.AfterFunc(config.Deadline, d.expireDeadline)
+	}
+	return d, nil
+}
+
+// restore Applies an event of the journal to the state of the coordinator
+func (d *DrawCoordinator) restore(record json.RawMessage) error {
+	var event drawEvent
+	if err := json.Unmarshal(record, &event); err != nil {
+		return err
+	}
+	switch event.Kind {
+	case eventCommitted:
+		seed, err := hex.DecodeString(event.Seed)
+		if err != nil {
+			return errors.Wrap(err, "draw seed")
+		}
+		d.seed = seed
+	case eventFinished:
+		d.finished[event.Agency] = true
+	case eventDrawn:
+		if event.WinningNumber != nil {
+			d.winningNumber = *event.WinningNumber
+		}
+		d.seeded = event.Seeded
+		d.participants = make(map[int]bool, len(event.Participants))
+		for _, agency := range event.Participants {
+			d.participants[agency] = true
+		}
+		d.winners = event.Winners
+		if d.winners == nil {
+			d.winners = make(map[int][]protocol.Winner)
+		}
+		d.drawn = true
+	default:
+		return errors.Errorf("unknown draw event %q", event.Kind)
+	}
+	return nil
+}
+
+// commit Generates the seed of the draw, unless it was restored from the
+// journal, and publishes its commitment. Must be called with mu locked
+func (d *DrawCoordinator) commit() error {
+	if d.seed == nil {
+		seed, err := lottery.NewSeed()
+		if err != nil {
+			return err
+		}
+		if err := d.record(drawEvent{Kind: eventCommitted, Seed: hex.EncodeToString(seed)}); err != nil {
+			log.Errorf("action: compromiso_sorteo | result: fail | error: %v", err)
+			return err
+		}
+		d.seed = seed
+	}
+	log.Infof("action: compromiso_sorteo | result: success | compromiso: %v", lottery.Commitment(d.seed))
+	return nil
+}
+
+// record Persists an event in the journal, if there is one
+func (d *DrawCoordinator) record(event drawEvent) error {
+	if d.journal == nil {
+		return nil
+	}
+	return d.journal.Append(event)
+}
+
+// Finish Registers that the agency sent all its bets. If that completes
+// the conditions of the draw, it is run before returning
+func (d *DrawCoordinator) Finish(agency int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.drawn {
+		log.Warningf("action: agencia_finalizada | result: fail | agencia: %v | error: draw already took place", agency)
+		return nil
+	}
+	if !d.finished[agency] {
+		if err := d.record(drawEvent{Kind: eventFinished, Agency: agency}); err != nil {
+			log.Errorf("action: agencia_finalizada | result: fail | agencia: %v | error: %v", agency, err)
+			return err
+		}
+		d.finished[agency] = true
+	}
+	log.Infof("action: agencia_finalizada | result: success | agencia: %v | finalizadas: %v/%v", agency, len(d.finished), d.config.ExpectedAgencies)
+	return d.drawIfReady()
+}
+
+// expireDeadline Runs the draw with the agencies that finished so far, or
+// as soon as the quorum is reached
+func (d *DrawCoordinator) expireDeadline() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deadlineExpired = true
+	if d.drawn {
+		return
+	}
+	if len(d.finished) < d.quorum() {
+		log.Warningf("action: sorteo | result: in_progress | finalizadas: %v | quorum: %v | error: deadline expired without quorum", len(d.finished), d.quorum())
+		return
+	}
+	d.drawIfReady()
+}
+
+// quorum Minimum amount of finished agencies for a draw after the deadline
+func (d *DrawCoordinator) quorum() int {
+	if d.config.Quorum < 1 {
+		return 1
+	}
+	return d.config.Quorum
+}
+
+// drawIfReady Runs the draw if every expected agency finished or if the
+// deadline expired and the quorum is reached. Must be called with mu locked
+func (d *DrawCoordinator) drawIfReady() error {
+	if d.drawn {
+		return nil
+	}
+	allFinished := len(d.finished) >= d.config.ExpectedAgencies
+	quorumAfterDeadline := d.deadlineExpired && len(d.finished) >= d.quorum()
+	if !allFinished && !quorumAfterDeadline {
+		return nil
+	}
+	return d.draw()
+}
+
+// draw Checks every stored bet of the finished agencies and keeps the
+// winners of each one with the tier they won. Must be called with mu locked
+func (d *DrawCoordinator) draw() error {
+	winningNumber := LotteryWinnerNumber
+	if d.config.Seeded {
+		winningNumber = lottery.WinningNumber(d.seed)
+	}
+	engine, err := NewWinnersEngineFromConfig(d.config.Prizes, winningNumber)
+	if err != nil {
+		return err
+	}
+
+	participants := make(map[int]bool, len(d.finished))
+	for agency := range d.finished {
+		participants[agency] = true
+	}
+
+	winners := make(map[int][]protocol.Winner)
+	err = d.store.Load(func(bet lottery.Bet) error {
+		if !participants[bet.Agency] {
+			return nil
+		}
+		if tier, won := engine.Prize(bet); won {
+			winners[bet.Agency] = append(winners[bet.Agency], protocol.Winner{Document: bet.Document, Tier: tier})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("action: sorteo | result: fail | error: %v", err)
+		return err
+	}
+	for _, agencyWinners := range winners {
+		sortWinners(agencyWinners)
+	}
+
+	event := drawEvent{
+		Kind:          eventDrawn,
+		WinningNumber: &winningNumber,
+		Seeded:        d.config.Seeded,
+		Participants:  sortedAgencies(participants),
+		Winners:       winners,
+	}
+	if err := d.record(event); err != nil {
+		log.Errorf("action: sorteo | result: fail | error: %v", err)
+		return err
+	}
+
+	d.participants = participants
+	d.winners = winners
+	d.winningNumber = winningNumber
+	d.seeded = d.config.Seeded
+	d.drawn = true
+	if d.deadline != nil {
+		d.deadline.Stop()
+	}
+	log.Infof("action: sorteo | result: success | agencias: %v | numero_ganador: %v | semilla: %v", formatAgencies(participants), winningNumber, hex.EncodeToString(d.seed))
+	return nil
+}
+
+// Winners Returns the winners of the agency. ok is false if the draw did
+// not take place yet. Agencies that did not take part in the draw have no
+// winners
+func (d *DrawCoordinator) Winners(agency int) (winners []protocol.Winner, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.drawn {
+		return nil, false
+	}
+	return d.winners[agency], true
+}
+
+// Info Returns the commitment of the draw and, once it took place, its
+// revealed seed, its winning number and whether it was derived from the seed
+func (d *DrawCoordinator) Info() protocol.DrawInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	info := protocol.DrawInfo{Commitment: lottery.Commitment(d.seed)}
+	if d.drawn {
+		info.Seed = hex.EncodeToString(d.seed)
+		info.WinningNumber = d.winningNumber
+		info.Seeded = d.seeded
+	}
+	return info
+}
+
+// Close Cancels the deadline of the draw, if any, and closes the journal
+func (d *DrawCoordinator) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.deadline != nil {
+		d.deadline.Stop()
+	}
+	if d.journal == nil {
+		return nil
+	}
+	return d.journal.Close()
+}
+
+// sortWinners Orders the winners by document
+func sortWinners(winners []protocol.Winner) {
+	sort.Slice(winners, func(i, j int) bool {
+		return winners[i].Document < winners[j].Document
+	})
+}
+
+// sortedAgencies Agencies of the set in ascending order
+func sortedAgencies(agencies map[int]bool) []int {
+	sorted := make([]int, 0, len(agencies))
+	for agency := range agencies {
+		sorted = append(sorted, agency)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+// formatAgencies Sorted, comma separated list of agencies for the logs
+func formatAgencies(agencies map[int]bool) string {
+	sorted := sortedAgencies(agencies)
+	names := make([]string, len(sorted))
+	for i, agency := range sorted {
+		names[i] = strconv.Itoa(agency)
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,251 @@
+package common
+
+import (
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/goserver/storage"
+)
+
+// openBets Opens a store in dir with a winning and a losing bet of
+// agencies 1, 2 and 3. The documents of the winners are their agency
+func openBets(t *testing.T, dir string) *storage.Store {
+	store, err := storage.Open(storage.Config{Path: filepath.Join(dir, "bets.csv")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	birthdate := time.Date(1999, time.March, 17, 0, 0, 0, 0, time.UTC)
+	var bets []lottery.Bet
+	for agency := 1; agency <= 3; agency++ {
+		document := strconv.Itoa(agency)
+		bets = append(bets,
+			lottery.Bet{Agency: agency, FirstName: "A", LastName: "B", Document: document, Birthdate: birthdate, Number: LotteryWinnerNumber},
+			lottery.Bet{Agency: agency, FirstName: "A", LastName: "B", Document: "9" + document, Birthdate: birthdate, Number: 1},
+		)
+	}
+	if err := store.Append(bets); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// checkWinners Checks that the draw took place and that only the given
+// agencies took part in it
+func checkWinners(t *testing.T, d *DrawCoordinator, participants ...int) {
+	t.Helper()
+	took := make(map[int]bool)
+	for _, agency := range participants {
+		took[agency] = true
+	}
+	for _, agency := range []int{1, 2, 3} {
+		winners, ok := d.Winners(agency)
+		if !ok {
+			t.Fatalf("Winners(%d) before the draw", agency)
+		}
+		var want []protocol.Winner
+		if took[agency] {
+			want = []protocol.Winner{{Document: strconv.Itoa(agency), Tier: DefaultPrizeTier}}
+		}
+		if !reflect.DeepEqual(winners, want) {
+			t.Errorf("Winners(%d) = %v, want %v", agency, winners, want)
+		}
+	}
+}
+
+// waitDrawn Waits until the draw takes place or timeout elapses
+func waitDrawn(d *DrawCoordinator, timeout time.Duration) bool {
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(time.Millisecond) {
+		if _, ok := d.Winners(1); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDrawAfterEveryAgencyFinished(t *testing.T) {
+	d, err := NewDrawCoordinator(openBets(t, t.TempDir()), DrawConfig{ExpectedAgencies: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Finish(1); err != nil {
+		t.Fatal(err)
+	}
+	// Finishing twice does not count the agency twice
+	if err := d.Finish(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Winners(1); ok {
+		t.Fatal("draw took place before every agency finished")
+	}
+	if info := d.Info(); info.Seed != "" {
+		t.Errorf("seed %v revealed before the draw", info.Seed)
+	}
+
+	if err := d.Finish(3); err != nil {
+		t.Fatal(err)
+	}
+	checkWinners(t, d, 1, 3)
+	if info := d.Info(); info.Seed == "" || info.WinningNumber != LotteryWinnerNumber {
+		t.Errorf("Info after the draw = %+v", info)
+	}
+}
+
+func TestDrawAfterDeadlineWithQuorum(t *testing.T) {
+	d, err := NewDrawCoordinator(openBets(t, t.TempDir()), DrawConfig{
+		ExpectedAgencies: 3,
+		Deadline:         20 * time.Millisecond,
+		Quorum:           2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for _, agency := range []int{1, 2} {
+		if err := d.Finish(agency); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitDrawn(d, 5*time.Second) {
+		t.Fatal("draw did not take place after the deadline")
+	}
+	checkWinners(t, d, 1, 2)
+
+	// Agencies that finish after the draw do not take part in it
+	if err := d.Finish(3); err != nil {
+		t.Fatal(err)
+	}
+	checkWinners(t, d, 1, 2)
+}
+
+func TestDrawAfterDeadlineWithoutQuorum(t *testing.T) {
+	d, err := NewDrawCoordinator(openBets(t, t.TempDir()), DrawConfig{
+		ExpectedAgencies: 3,
+		Deadline:         10 * time.Millisecond,
+		Quorum:           2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Finish(1); err != nil {
+		t.Fatal(err)
+	}
+	if waitDrawn(d, 100*time.Millisecond) {
+		t.Fatal("draw took place after the deadline without quorum")
+	}
+
+	// Once the deadline expired, reaching the quorum runs the draw
+	if err := d.Finish(3); err != nil {
+		t.Fatal(err)
+	}
+	checkWinners(t, d, 1, 3)
+}
+
+func TestDrawConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config DrawConfig
+	}{
+		{"no expected agencies", DrawConfig{}},
+		{"negative quorum", DrawConfig{ExpectedAgencies: 2, Quorum: -1}},
+		{"quorum above the expected agencies", DrawConfig{ExpectedAgencies: 2, Quorum: 3}},
+		{"invalid prize rule", DrawConfig{ExpectedAgencies: 2, Prizes: []PrizeConfig{{Tier: "t", Rule: "closest"}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if d, err := NewDrawCoordinator(nil, test.config); err == nil {
+				d.Close()
+				t.Errorf("NewDrawCoordinator(%+v) succeeded", test.config)
+			}
+		})
+	}
+}
+
+func TestDrawResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	store := openBets(t, dir)
+	config := DrawConfig{ExpectedAgencies: 3, StatePath: filepath.Join(dir, "draw.jsonl")}
+
+	d, err := NewDrawCoordinator(store, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, agency := range []int{1, 2} {
+		if err := d.Finish(agency); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commitment := d.Info().Commitment
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = NewDrawCoordinator(store, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if got := d.Info().Commitment; got != commitment {
+		t.Errorf("commitment %v after a restart, want %v", got, commitment)
+	}
+	if _, ok := d.Winners(1); ok {
+		t.Fatal("draw took place after a restart before every agency finished")
+	}
+	// The agencies that finished before the restart still count
+	if err := d.Finish(3); err != nil {
+		t.Fatal(err)
+	}
+	checkWinners(t, d, 1, 2, 3)
+}
+
+func TestDrawRestoredAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	store := openBets(t, dir)
+	config := DrawConfig{ExpectedAgencies: 2, StatePath: filepath.Join(dir, "draw.jsonl")}
+
+	d, err := NewDrawCoordinator(store, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, agency := range []int{1, 3} {
+		if err := d.Finish(agency); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info := d.Info()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A bet stored after the draw shows whether the winners are recomputed
+	late := lottery.Bet{Agency: 1, FirstName: "A", LastName: "B", Document: "5", Birthdate: time.Date(1999, time.March, 17, 0, 0, 0, 0, time.UTC), Number: LotteryWinnerNumber}
+	if err := store.Append([]lottery.Bet{late}); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = NewDrawCoordinator(store, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	checkWinners(t, d, 1, 3)
+	if got := d.Info(); got != info {
+		t.Errorf("Info after a restart = %+v, want %+v", got, info)
+	}
+	// The draw already took place, so agency 2 does not take part in it
+	if err := d.Finish(2); err != nil {
+		t.Fatal(err)
+	}
+	checkWinners(t, d, 1, 3)
+}
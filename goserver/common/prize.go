@@ -0,0 +1,188 @@
+package common
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+)
+
+// DefaultPrizeTier Tier awarded by the default rules to bets that match
+// the winning number of the draw
+const DefaultPrizeTier = "primer_premio"
+
+// Kinds of prize rules accepted in the configuration
+const (
+	// PrizeRuleExact The bet number is exactly the winning number
+	PrizeRuleExact = "exact"
+	// PrizeRuleLastDigits The last digits of the bet number match the ones
+	// of the winning number
+	PrizeRuleLastDigits = "last_digits"
+	// PrizeRuleNumbers The bet number is any of several winning numbers
+	PrizeRuleNumbers = "numbers"
+)
+
+// maxDigits Largest amount of digits a last digits rule may compare
+const maxDigits = 9
+
+// PrizeRule Decides whether a bet wins the prize tier of the rule
+type PrizeRule interface {
+	// Tier Name of the prize tier awarded by the rule
+	Tier() string
+	// Matches Checks whether the bet wins the prize of the rule
+	Matches(bet lottery.Bet) bool
+}
+
+// PrizeConfig Configuration of a prize rule. Number is used by exact and
+// last_digits rules and defaults to the winning number of the draw. Digits
+// is used by last_digits rules and Numbers by numbers rules
+type PrizeConfig struct {
+	Tier    string `mapstructure:"tier"`
+	Rule    string `mapstructure:"rule"`
+	Number  *int   `mapstructure:"number"`
+	Digits  int    `mapstructure:"digits"`
+	Numbers []int  `mapstructure:"numbers"`
+}
+
+// NewPrizeRule Builds the rule described by the configuration for a draw
+// whose winning number is winningNumber
+func NewPrizeRule(config PrizeConfig, winningNumber int) (PrizeRule, error) {
+	if config.Tier == "" {
+		return nil, errors.Errorf("prize rule %q without tier", config.Rule)
+	}
+	number := winningNumber
+	if config.Number != nil {
+		number = *config.Number
+	}
+	switch config.Rule {
+	case PrizeRuleExact:
+		return NewExactMatchRule(config.Tier, number), nil
+	case PrizeRuleLastDigits:
+		return NewLastDigitsRule(config.Tier, number, config.Digits)
+	case PrizeRuleNumbers:
+		return NewWinningNumbersRule(config.Tier, config.Numbers)
+	default:
+		return nil, errors.Errorf("unknown prize rule %q", config.Rule)
+	}
+}
+
+// ExactMatchRule Awards its tier to the bets whose number is the winning one
+type ExactMatchRule struct {
+	tier   string
+	number int
+}
+
+// NewExactMatchRule Initializes an exact match rule
+func NewExactMatchRule(tier string, number int) *ExactMatchRule {
+	return &ExactMatchRule{tier: tier, number: number}
+}
+
+// Tier Name of the prize tier awarded by the rule
+func (r *ExactMatchRule) Tier() string {
+	return r.tier
+}
+
+// Matches Checks whether the bet number is the winning number
+func (r *ExactMatchRule) Matches(bet lottery.Bet) bool {
+	return bet.Number == r.number
+}
+
+// LastDigitsRule Awards its tier to the bets whose number ends with the same
+// digits as the winning number
+type LastDigitsRule struct {
+	tier    string
+	modulus int
+	suffix  int
+}
+
+// NewLastDigitsRule Initializes a rule that compares the last digits of the
+// bet number with the ones of the winning number
+func NewLastDigitsRule(tier string, number int, digits int) (*LastDigitsRule, error) {
+	if digits < 1 || digits > maxDigits {
+		return nil, errors.Errorf("prize tier %q compares %d digits, must be between 1 and %d", tier, digits, maxDigits)
+	}
+	modulus := 1
+	for i := 0; i < digits; i++ {
+		modulus *= 10
+	}
+	return &LastDigitsRule{tier: tier, modulus: modulus, suffix: number % modulus}, nil
+}
+
+// Tier Name of the prize tier awarded by the rule
+func (r *LastDigitsRule) Tier() string {
+	return r.tier
+}
+
+// Matches Checks whether the bet number ends with the winning digits
+func (r *LastDigitsRule) Matches(bet lottery.Bet) bool {
+	return bet.Number%r.modulus == r.suffix
+}
+
+// WinningNumbersRule Awards its tier to the bets whose number is any of
+// several winning numbers
+type WinningNumbersRule struct {
+	tier    string
+	numbers map[int]bool
+}
+
+// NewWinningNumbersRule Initializes a rule with several winning numbers
+func NewWinningNumbersRule(tier string, numbers []int) (*WinningNumbersRule, error) {
+	if len(numbers) == 0 {
+		return nil, errors.Errorf("prize tier %q without winning numbers", tier)
+	}
+	rule := &WinningNumbersRule{tier: tier, numbers: make(map[int]bool, len(numbers))}
+	for _, number := range numbers {
+		rule.numbers[number] = true
+	}
+	return rule, nil
+}
+
+// Tier Name of the prize tier awarded by the rule
+func (r *WinningNumbersRule) Tier() string {
+	return r.tier
+}
+
+// Matches Checks whether the bet number is one of the winning numbers
+func (r *WinningNumbersRule) Matches(bet lottery.Bet) bool {
+	return r.numbers[bet.Number]
+}
+
+// WinnersEngine Decides the prize tier won by each bet. Rules are checked in
+// order, from the highest prize to the lowest, and a bet wins at most the
+// tier of the first rule it matches
+type WinnersEngine struct {
+	rules []PrizeRule
+}
+
+// NewWinnersEngine Initializes an engine with the given rules. Without rules
+// it awards DefaultPrizeTier to the bets that match winningNumber
+func NewWinnersEngine(winningNumber int, rules ...PrizeRule) *WinnersEngine {
+	if len(rules) == 0 {
+		rules = []PrizeRule{NewExactMatchRule(DefaultPrizeTier, winningNumber)}
+	}
+	return &WinnersEngine{rules: rules}
+}
+
+// NewWinnersEngineFromConfig Builds an engine with the configured rules for
+// a draw whose winning number is winningNumber
+func NewWinnersEngineFromConfig(configs []PrizeConfig, winningNumber int) (*WinnersEngine, error) {
+	rules := make([]PrizeRule, 0, len(configs))
+	for _, config := range configs {
+		rule, err := NewPrizeRule(config, winningNumber)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return NewWinnersEngine(winningNumber, rules...), nil
+}
+
+// Prize Returns the tier won by the bet. won is false if the bet matches
+// none of the rules
+func (e *WinnersEngine) Prize(bet lottery.Bet) (tier string, won bool) {
+	for _, rule := range e.rules {
+		if rule.Matches(bet) {
+			return rule.Tier(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,135 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+)
+
+func intPointer(value int) *int {
+	return &value
+}
+
+func TestPrizeRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		config PrizeConfig
+		number int
+		want   bool
+	}{
+		{"exact winning number", PrizeConfig{Tier: "t", Rule: PrizeRuleExact}, LotteryWinnerNumber, true},
+		{"exact other number", PrizeConfig{Tier: "t", Rule: PrizeRuleExact}, LotteryWinnerNumber + 1, false},
+		{"exact configured number", PrizeConfig{Tier: "t", Rule: PrizeRuleExact, Number: intPointer(1234)}, 1234, true},
+		{"exact ignores the winning number", PrizeConfig{Tier: "t", Rule: PrizeRuleExact, Number: intPointer(1234)}, LotteryWinnerNumber, false},
+		{"last digits match", PrizeConfig{Tier: "t", Rule: PrizeRuleLastDigits, Digits: 2}, 1274, true},
+		{"last digits of a shorter number", PrizeConfig{Tier: "t", Rule: PrizeRuleLastDigits, Digits: 2}, 74, true},
+		{"last digits differ", PrizeConfig{Tier: "t", Rule: PrizeRuleLastDigits, Digits: 2}, 7575, false},
+		{"last digits of a configured number", PrizeConfig{Tier: "t", Rule: PrizeRuleLastDigits, Number: intPointer(1230), Digits: 1}, 40, true},
+		{"numbers first", PrizeConfig{Tier: "t", Rule: PrizeRuleNumbers, Numbers: []int{10, 20, 30}}, 10, true},
+		{"numbers last", PrizeConfig{Tier: "t", Rule: PrizeRuleNumbers, Numbers: []int{10, 20, 30}}, 30, true},
+		{"numbers none", PrizeConfig{Tier: "t", Rule: PrizeRuleNumbers, Numbers: []int{10, 20, 30}}, LotteryWinnerNumber, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, err := NewPrizeRule(test.config, LotteryWinnerNumber)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rule.Matches(lottery.Bet{Number: test.number}); got != test.want {
+				t.Errorf("Matches(%d) = %v, want %v", test.number, got, test.want)
+			}
+			if rule.Tier() != test.config.Tier {
+				t.Errorf("Tier = %q, want %q", rule.Tier(), test.config.Tier)
+			}
+		})
+	}
+}
+
+func TestPrizeRuleErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config PrizeConfig
+	}{
+		{"without tier", PrizeConfig{Rule: PrizeRuleExact}},
+		{"unknown rule", PrizeConfig{Tier: "t", Rule: "closest"}},
+		{"no digits", PrizeConfig{Tier: "t", Rule: PrizeRuleLastDigits}},
+		{"too many digits", PrizeConfig{Tier: "t", Rule: PrizeRuleLastDigits, Digits: maxDigits + 1}},
+		{"without numbers", PrizeConfig{Tier: "t", Rule: PrizeRuleNumbers}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewPrizeRule(test.config, LotteryWinnerNumber); err == nil {
+				t.Errorf("NewPrizeRule(%+v) succeeded", test.config)
+			}
+		})
+	}
+}
+
+func TestWinnersEngineRuleOrder(t *testing.T) {
+	configs := []PrizeConfig{
+		{Tier: "primer_premio", Rule: PrizeRuleExact},
+		{Tier: "terminacion", Rule: PrizeRuleLastDigits, Digits: 2},
+		{Tier: "reintegro", Rule: PrizeRuleLastDigits, Digits: 1},
+	}
+	engine, err := NewWinnersEngineFromConfig(configs, LotteryWinnerNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		number int
+		tier   string
+		won    bool
+	}{
+		{LotteryWinnerNumber, "primer_premio", true},
+		{1174, "terminacion", true},
+		{1114, "reintegro", true},
+		{1115, "", false},
+	}
+	for _, test := range tests {
+		tier, won := engine.Prize(lottery.Bet{Number: test.number})
+		if tier != test.tier || won != test.won {
+			t.Errorf("Prize(%d) = %q, %v, want %q, %v", test.number, tier, won, test.tier, test.won)
+		}
+	}
+
+	// The first matching rule wins even if a later one awards more
+	reversed := []PrizeConfig{configs[2], configs[1], configs[0]}
+	engine, err = NewWinnersEngineFromConfig(reversed, LotteryWinnerNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tier, _ := engine.Prize(lottery.Bet{Number: LotteryWinnerNumber}); tier != "reintegro" {
+		t.Errorf("Prize(%d) with reversed rules = %q, want %q", LotteryWinnerNumber, tier, "reintegro")
+	}
+}
+
+func TestDefaultWinnersEngine(t *testing.T) {
+	fromConfig, err := NewWinnersEngineFromConfig(nil, LotteryWinnerNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engines := []struct {
+		name   string
+		engine *WinnersEngine
+	}{
+		{"NewWinnersEngine", NewWinnersEngine(LotteryWinnerNumber)},
+		{"NewWinnersEngineFromConfig", fromConfig},
+	}
+	for _, test := range engines {
+		engine := test.engine
+		t.Run(test.name, func(t *testing.T) {
+			for _, number := range []int{0, 74, 574, 1574, LotteryWinnerNumber - 1, LotteryWinnerNumber, LotteryWinnerNumber + 1, 17574, 99999} {
+				tier, won := engine.Prize(lottery.Bet{Number: number})
+				// The original server only awards the bets of number 7574
+				wantWon := number == LotteryWinnerNumber
+				if won != wantWon {
+					t.Errorf("Prize(%d) won = %v, want %v", number, won, wantWon)
+				}
+				if wantWon && tier != DefaultPrizeTier {
+					t.Errorf("Prize(%d) tier = %q, want %q", number, tier, DefaultPrizeTier)
+				}
+			}
+		})
+	}
+}
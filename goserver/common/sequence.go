@@ -0,0 +1,66 @@
+package common
+
+import "sync"
+
+// batchSequencer Remembers, for each agency, the session its batches belong
+// to and the greatest sequence number committed in it, so that a batch
+// resent after its ack was lost is not stored twice. The sequences are
+// persisted, if at all, by the store together with the bets of their
+// batches, and restored after a restart so a resent batch is recognized
+// as well
+type batchSequencer struct {
+	mu       sync.Mutex
+	agencies map[int]*batchSession
+}
+
+// batchSession Sequence of the batches of an agency. Its mutex is held
+// from the duplicate check until the batch is committed, so a resent batch
+// waits for the original one instead of racing it
+type batchSession struct {
+	sync.Mutex
+	agency    int
+	id        uint64
+	committed uint32
+}
+
+// acquire Returns the locked sequence of the agency. The caller must
+// unlock it
+func (s *batchSequencer) acquire(agency int) *batchSession {
+	s.mu.Lock()
+	if s.agencies == nil {
+		s.agencies = make(map[int]*batchSession)
+	}
+	session, ok := s.agencies[agency]
+	if !ok {
+		session = &batchSession{agency: agency}
+		s.agencies[agency] = session
+	}
+	s.mu.Unlock()
+
+	session.Lock()
+	return session
+}
+
+// restore Registers a batch of the agency that was already committed
+func (s *batchSequencer) restore(agency int, id uint64, sequence uint32) {
+	session := s.acquire(agency)
+	defer session.Unlock()
+	session.commit(id, sequence)
+}
+
+// isDuplicate Checks whether the batch was already committed
+func (b *batchSession) isDuplicate(id uint64, sequence uint32) bool {
+	return b.id == id && sequence <= b.committed
+}
+
+// commit Registers the batch as committed. A batch of a new session
+// replaces the previous session of the agency
+func (b *batchSession) commit(id uint64, sequence uint32) {
+	if b.id != id {
+		b.id = id
+		b.committed = 0
+	}
+	if sequence > b.committed {
+		b.committed = sequence
+	}
+}
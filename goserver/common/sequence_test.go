@@ -0,0 +1,145 @@
+package common
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/goserver/storage"
+)
+
+func TestBatchSessionDuplicates(t *testing.T) {
+	var session batchSession
+	steps := []struct {
+		name      string
+		id        uint64
+		sequence  uint32
+		duplicate bool
+	}{
+		{"first batch", 10, 1, false},
+		{"resent first batch", 10, 1, true},
+		{"second batch", 10, 2, false},
+		{"resent older batch", 10, 1, true},
+		{"batch of a new session", 20, 1, false},
+		{"batch of the replaced session", 10, 2, false},
+	}
+	for _, step := range steps {
+		if got := session.isDuplicate(step.id, step.sequence); got != step.duplicate {
+			t.Fatalf("%s: isDuplicate(%d, %d) = %v, want %v", step.name, step.id, step.sequence, got, step.duplicate)
+		}
+		if !step.duplicate {
+			session.commit(step.id, step.sequence)
+		}
+	}
+}
+
+func TestBatchSequencerSeparatesAgencies(t *testing.T) {
+	var sequencer batchSequencer
+	first := sequencer.acquire(1)
+	first.commit(10, 1)
+	first.Unlock()
+
+	second := sequencer.acquire(2)
+	defer second.Unlock()
+	if second.isDuplicate(10, 1) {
+		t.Errorf("batch of agency 1 is a duplicate for agency 2")
+	}
+}
+
+func TestBatchSequencesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sessions.jsonl")
+
+	var nonces nonceGuard
+	var batches batchSequencer
+	sessions, err := openSessions(path, &nonces, &batches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.Open(storage.Config{
+		Path:          filepath.Join(dir, "bets.csv"),
+		Sync:          storage.SyncGroup,
+		GroupMaxDelay: time.Millisecond,
+		GroupMaxSize:  8,
+		Recorder:      sessions,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bet := lottery.Bet{Agency: 1, FirstName: "A", LastName: "B", Document: "1", Number: 7574}
+	for sequence := uint32(1); sequence <= 3; sequence++ {
+		event := sessionEvent{Kind: eventBatch, Agency: 1, Session: 10, Sequence: sequence}
+		if err := store.Append([]lottery.Bet{bet}, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var restoredNonces nonceGuard
+	var restored batchSequencer
+	sessions, err = openSessions(path, &restoredNonces, &restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.Close()
+
+	session := restored.acquire(1)
+	defer session.Unlock()
+	if !session.isDuplicate(10, 3) {
+		t.Errorf("committed batch 3 is not a duplicate after a restart")
+	}
+	if session.isDuplicate(10, 4) {
+		t.Errorf("batch 4 is a duplicate after a restart")
+	}
+}
+
+func TestSessionsJournalCompactsWhileRunning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	var nonces nonceGuard
+	var batches batchSequencer
+	sessions, err := openSessions(path, &nonces, &batches)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := 3 * sessionsCompactEvery
+	for i := 1; i <= events; i++ {
+		event := sessionEvent{Kind: eventBatch, Agency: i%2 + 1, Session: 10, Sequence: uint32(i)}
+		if err := sessions.Record([]interface{}{event}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sessions.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines >= sessionsCompactEvery {
+		t.Errorf("journal of %d lines after %d events, want less than %d", lines, events, sessionsCompactEvery)
+	}
+
+	var restored batchSequencer
+	sessions, err = openSessions(path, &nonces, &restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.Close()
+	for agency, last := range map[int]uint32{1: uint32(events), 2: uint32(events - 1)} {
+		session := restored.acquire(agency)
+		if !session.isDuplicate(10, last) || session.isDuplicate(10, last+1) {
+			t.Errorf("agency %d restored at sequence %d, want %d", agency, session.committed, last)
+		}
+		session.Unlock()
+	}
+}
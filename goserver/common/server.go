@@ -0,0 +1,454 @@
+package common
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/goserver/storage"
+)
+
+var log = logging.MustGetLogger("log")
+
+// ServerConfig Configuration used by the server
+type ServerConfig struct {
+	Address      string
+	MaxFrameSize int
+	Storage      storage.Config
+	Draw         DrawConfig
+	// SigningKey Key that signs the winners responses. Nil sends them
+	// unsigned
+	SigningKey ed25519.PrivateKey
+	// TLS Configuration of the accepted connections. Nil accepts them
+	// without TLS. See LoadTLSConfig
+	TLS *tls.Config
+	// AuthSecrets Secret of each agency. When set every request must be
+	// sealed by its agency with protocol.SealFrame. See LoadSecrets
+	AuthSecrets map[int][]byte
+	// SessionsPath Journal where the last nonce and the last committed batch
+	// of each agency are persisted so they survive restarts. Empty keeps
+	// them in memory only
+	SessionsPath string
+	// NonceReserve Time of the client clock covered by each block of nonces
+	// persisted with a single fsync. After a restart, the agencies are
+	// rejected until their clock passes the last block reserved. Zero
+	// persists every nonce
+	NonceReserve time.Duration
+}
+
+// Server Central lottery server. Every connection is handled in its own
+// goroutine, while the bet store and the draw coordinator synchronize the state
+// shared between them
+type Server struct {
+	config   ServerConfig
+	listener net.Listener
+	store    *storage.Store
+	draw     *DrawCoordinator
+	nonces   nonceGuard
+	batches  batchSequencer
+	// sessions Journal of the nonces and batch sequences, nil if they are
+	// kept in memory only
+	sessions *sessionJournal
+
+	// mu Protects conns, the connections being handled
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewServer Initializes the server and starts listening on the configured
+// address
+func NewServer(config ServerConfig) (*Server, error) {
+	s := &Server{
+		config: config,
+		conns:  make(map[net.Conn]struct{}),
+	}
+	if config.NonceReserve > 0 {
+		s.nonces.reserve = uint64(config.NonceReserve.Nanoseconds())
+	}
+	var err error
+	if config.SessionsPath != "" {
+		if s.sessions, err = openSessions(config.SessionsPath, &s.nonces, &s.batches); err != nil {
+			return nil, err
+		}
+		// The sequence of every batch is recorded in the same group commit
+		// as its bets
+		config.Storage.Recorder = s.sessions
+	}
+	if s.store, err = storage.Open(config.Storage); err != nil {
+		s.closeSessions()
+		return nil, err
+	}
+	if s.draw, err = NewDrawCoordinator(s.store, config.Draw); err != nil {
+		s.store.Close()
+		s.closeSessions()
+		return nil, err
+	}
+	s.listener, err = net.Listen("tcp", config.Address)
+	if err != nil {
+		s.draw.Close()
+		s.store.Close()
+		s.closeSessions()
+		return nil, err
+	}
+	if config.TLS != nil {
+		// The handshake of every connection takes place on its first read
+		s.listener = tls.NewListener(s.listener, config.TLS)
+	}
+	return s, nil
+}
+
+// closeSessions Closes the sessions journal, if any
+func (s *Server) closeSessions() error {
+	if s.sessions == nil {
+		return nil
+	}
+	return s.sessions.Close()
+}
+
+// Run Accepts connections until ctx is done. Then the listener and every
+// open connection are closed and Run waits for their goroutines to finish
+func (s *Server) Run(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		s.listener.Close()
+	}()
+
+	for {
+		log.Infof("action: accept_connections | result: in_progress")
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Errorf("action: accept_connections | result: fail | error: %v", err)
+			s.shutdown()
+			return err
+		}
+		log.Infof("action: accept_connections | result: success | ip: %v", remoteIP(conn))
+
+		s.track(conn)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.handleClientConnection(conn)
+		}()
+	}
+
+	s.shutdown()
+	return nil
+}
+
+// shutdown Closes every open connection, waits for their handlers and
+// closes the bets storage
+func (s *Server) shutdown() {
+	log.Infof("action: shutdown | result: success | resource: listener")
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	log.Infof("action: shutdown | result: success | resource: connections")
+
+	if err := s.draw.Close(); err != nil {
+		log.Errorf("action: shutdown | result: fail | resource: draw_state | error: %v", err)
+	} else {
+		log.Infof("action: shutdown | result: success | resource: draw_state")
+	}
+
+	if err := s.closeSessions(); err != nil {
+		log.Errorf("action: shutdown | result: fail | resource: sessions_state | error: %v", err)
+	} else {
+		log.Infof("action: shutdown | result: success | resource: sessions_state")
+	}
+
+	if err := s.store.Close(); err != nil {
+		log.Errorf("action: shutdown | result: fail | resource: storage | error: %v", err)
+		return
+	}
+	log.Infof("action: shutdown | result: success | resource: storage")
+}
+
+func (s *Server) track(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = struct{}{}
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	conn.Close()
+}
+
+// session Client connection being served
+type session struct {
+	ip string
+	// agency Agency authenticated by the client certificate. Zero if client
+	// certificates are not required, in which case any agency is accepted
+	agency int
+}
+
+// authorizes Checks whether the connection may act on behalf of the agency
+func (s session) authorizes(agency int) bool {
+	return s.agency == 0 || s.agency == agency
+}
+
+// authenticate Completes the TLS handshake of the connection, if any, and
+// returns the session with the agency identified by the client certificate
+func (s *Server) authenticate(conn net.Conn) (session, error) {
+	sess := session{ip: remoteIP(conn)}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || s.config.TLS.ClientAuth != tls.RequireAndVerifyClientCert {
+		return sess, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return sess, err
+	}
+	agency, err := AgencyFromCertificate(tlsConn.ConnectionState().PeerCertificates[0])
+	if err != nil {
+		return sess, err
+	}
+	sess.agency = agency
+	log.Infof("action: autenticar_agencia | result: success | ip: %v | agencia: %v", sess.ip, agency)
+	return sess, nil
+}
+
+// handleClientConnection Reads requests from the connection and answers
+// each one until the client closes it or an error is found
+func (s *Server) handleClientConnection(conn net.Conn) {
+	sess, err := s.authenticate(conn)
+	if err != nil {
+		log.Errorf("action: autenticar_agencia | result: fail | ip: %v | error: %v", remoteIP(conn), err)
+		return
+	}
+
+	reader := protocol.NewReader(conn, s.config.MaxFrameSize)
+	writer := protocol.NewWriter(conn, s.config.MaxFrameSize)
+
+	for {
+		request, err := reader.ReadFrame()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Errorf("action: receive_message | result: fail | ip: %v | error: %v", remoteIP(conn), err)
+			return
+		}
+
+		requestSess := sess
+		if len(s.config.AuthSecrets) > 0 {
+			request, requestSess, err = s.openRequest(sess, request)
+			if err != nil {
+				log.Errorf("action: autenticar_mensaje | result: fail | ip: %v | error: %v", sess.ip, err)
+				code := protocol.AckMalformedMessage
+				switch {
+				case errors.Is(err, protocol.ErrAuthentication):
+					code = protocol.AckAuthenticationFailed
+				case errors.Is(err, errSessionState):
+					code = protocol.AckStorageError
+				}
+				writer.WriteFrame(protocol.EncodeAck(protocol.Ack{Code: code}))
+				return
+			}
+		}
+
+		response, err := s.handleRequest(requestSess, request)
+		if err != nil {
+			log.Errorf("action: receive_message | result: fail | ip: %v | error: %v", remoteIP(conn), err)
+			writer.WriteFrame(protocol.EncodeAck(protocol.Ack{Code: protocol.AckMalformedMessage}))
+			return
+		}
+		err = writer.WriteFrame(response)
+		if errors.Is(err, protocol.ErrFrameTooLarge) {
+			// Nothing was written, so the client can still be told why
+			log.Errorf("action: send_message | result: fail | ip: %v | error: %v", remoteIP(conn), err)
+			err = writer.WriteFrame(protocol.EncodeAck(protocol.Ack{Code: protocol.AckResponseTooLarge}))
+		}
+		if err != nil {
+			log.Errorf("action: send_message | result: fail | ip: %v | error: %v", remoteIP(conn), err)
+			return
+		}
+	}
+}
+
+// handleRequest Returns the response to a request. An error is returned
+// only when the request cannot be understood at all. Requests on behalf of
+// an agency other than the authenticated one are answered with
+// AckAgencyMismatch
+func (s *Server) handleRequest(sess session, request protocol.Frame) (protocol.Frame, error) {
+	switch request.Type {
+	case protocol.MsgEcho:
+		return request, nil
+	case protocol.MsgBet:
+		return s.handleBet(sess, request), nil
+	case protocol.MsgBatch:
+		return s.handleBatch(sess, request), nil
+	case protocol.MsgFinished:
+		return s.handleFinished(sess, request)
+	case protocol.MsgWinnersQuery:
+		return s.handleWinnersQuery(sess, request)
+	case protocol.MsgDrawQuery:
+		return protocol.EncodeDraw(s.draw.Info())
+	default:
+		return protocol.Frame{}, errors.Wrapf(protocol.ErrUnexpectedMessage, "type %d", request.Type)
+	}
+}
+
+func (s *Server) handleBet(sess session, request protocol.Frame) protocol.Frame {
+	bet, err := protocol.DecodeBet(request)
+	if err != nil {
+		log.Errorf("action: apuesta_almacenada | result: fail | error: %v", err)
+		return protocol.EncodeAck(protocol.Ack{Code: decodeErrorCode(err), Count: 1})
+	}
+	if !sess.authorizes(bet.Agency) {
+		log.Errorf("action: apuesta_almacenada | result: fail | ip: %v | agencia: %v | error: agency mismatch, authenticated as %v", sess.ip, bet.Agency, sess.agency)
+		return protocol.EncodeAck(protocol.Ack{Code: protocol.AckAgencyMismatch, Count: 1})
+	}
+	if err := s.store.Append([]lottery.Bet{bet}); err != nil {
+		log.Errorf("action: apuesta_almacenada | result: fail | dni: %v | numero: %v | error: %v", bet.Document, bet.Number, err)
+		return protocol.EncodeAck(protocol.Ack{Code: protocol.AckStorageError, Count: 1})
+	}
+	log.Infof("action: apuesta_almacenada | result: success | dni: %v | numero: %v", bet.Document, bet.Number)
+	return protocol.EncodeAck(protocol.Ack{Code: protocol.AckSuccess, Count: 1})
+}
+
+// handleBatch Stores every bet of the batch or none of them. The ack
+// always refers to the amount of bets the batch claims to carry. A
+// sequenced batch already committed in the session of its agency is not
+// stored again and gets the same successful ack as the first time
+func (s *Server) handleBatch(sess session, request protocol.Frame) protocol.Frame {
+	count, _ := protocol.BatchLen(request)
+	id, sequence, _ := protocol.BatchSequence(request)
+	bets, err := protocol.DecodeBatch(request)
+	if err != nil {
+		log.Errorf("action: apuesta_recibida | result: fail | cantidad: %v | error: %v", count, err)
+		return protocol.EncodeAck(protocol.Ack{Code: decodeErrorCode(err), Count: uint32(count)})
+	}
+	for _, bet := range bets {
+		if !sess.authorizes(bet.Agency) {
+			log.Errorf("action: apuesta_recibida | result: fail | cantidad: %v | ip: %v | agencia: %v | error: agency mismatch, authenticated as %v", count, sess.ip, bet.Agency, sess.agency)
+			return protocol.EncodeAck(protocol.Ack{Code: protocol.AckAgencyMismatch, Count: uint32(count)})
+		}
+	}
+
+	var batchSession *batchSession
+	if id != 0 && len(bets) > 0 {
+		batchSession = s.batches.acquire(bets[0].Agency)
+		defer batchSession.Unlock()
+		if batchSession.isDuplicate(id, sequence) {
+			log.Infof("action: apuesta_recibida | result: success | cantidad: %v | agencia: %v | secuencia: %v | duplicado: true", count, bets[0].Agency, sequence)
+			return protocol.EncodeAck(protocol.Ack{Code: protocol.AckSuccess, Count: uint32(count)})
+		}
+	}
+
+	var records []interface{}
+	if batchSession != nil {
+		records = append(records, sessionEvent{Kind: eventBatch, Agency: bets[0].Agency, Session: id, Sequence: sequence})
+	}
+	err = s.store.Append(bets, records...)
+	if batchSession != nil && (err == nil || errors.Is(err, errSessionState)) {
+		// The bets are stored even if their sequence could not be
+		// persisted, in which case a resent batch is only recognized
+		// until a restart
+		batchSession.commit(id, sequence)
+	}
+	if err != nil {
+		log.Errorf("action: apuesta_recibida | result: fail | cantidad: %v | error: %v", count, err)
+		return protocol.EncodeAck(protocol.Ack{Code: protocol.AckStorageError, Count: uint32(count)})
+	}
+	log.Infof("action: apuesta_recibida | result: success | cantidad: %v", count)
+	return protocol.EncodeAck(protocol.Ack{Code: protocol.AckSuccess, Count: uint32(count)})
+}
+
+func (s *Server) handleFinished(sess session, request protocol.Frame) (protocol.Frame, error) {
+	agency, err := protocol.DecodeFinished(request)
+	if err != nil {
+		return protocol.Frame{}, err
+	}
+	if !sess.authorizes(agency) {
+		log.Errorf("action: agencia_finalizada | result: fail | ip: %v | agencia: %v | error: agency mismatch, authenticated as %v", sess.ip, agency, sess.agency)
+		return protocol.EncodeAck(protocol.Ack{Code: protocol.AckAgencyMismatch}), nil
+	}
+	if err := s.draw.Finish(agency); err != nil {
+		return protocol.EncodeAck(protocol.Ack{Code: protocol.AckStorageError}), nil
+	}
+	return protocol.EncodeAck(protocol.Ack{Code: protocol.AckSuccess}), nil
+}
+
+// handleWinnersQuery Answers with the page of the winners of the agency
+// the query asks for, signed if a signing key is configured, or, if the
+// draw did not take place yet, with AckDrawPending so the client retries
+// later. Pages fit in the smallest of the maximum frame sizes of the
+// server and the client
+func (s *Server) handleWinnersQuery(sess session, request protocol.Frame) (protocol.Frame, error) {
+	query, err := protocol.DecodeWinnersQuery(request)
+	if err != nil {
+		return protocol.Frame{}, err
+	}
+	agency := query.Agency
+	if !sess.authorizes(agency) {
+		log.Errorf("action: consulta_ganadores | result: fail | ip: %v | agencia: %v | error: agency mismatch, authenticated as %v", sess.ip, agency, sess.agency)
+		return protocol.EncodeAck(protocol.Ack{Code: protocol.AckAgencyMismatch}), nil
+	}
+	winners, ok := s.draw.Winners(agency)
+	if !ok {
+		return protocol.EncodeAck(protocol.Ack{Code: protocol.AckDrawPending}), nil
+	}
+	info := s.draw.Info()
+	response := protocol.WinnersResponse{
+		Agency:        agency,
+		DrawID:        info.Commitment,
+		WinningNumber: info.WinningNumber,
+		Winners:       winners,
+	}
+	if s.config.SigningKey != nil {
+		protocol.SignWinners(s.config.SigningKey, &response)
+	}
+
+	maxFrameSize := s.config.MaxFrameSize
+	if maxFrameSize <= 0 {
+		maxFrameSize = protocol.DefaultMaxFrameSize
+	}
+	if query.MaxFrameSize > 0 && query.MaxFrameSize < maxFrameSize {
+		maxFrameSize = query.MaxFrameSize
+	}
+	page, err := protocol.EncodeWinners(response, query.Offset, maxFrameSize)
+	if err != nil {
+		log.Errorf("action: consulta_ganadores | result: fail | agencia: %v | desde: %v | error: %v", agency, query.Offset, err)
+		code := protocol.AckMalformedMessage
+		if errors.Is(err, protocol.ErrFrameTooLarge) {
+			code = protocol.AckResponseTooLarge
+		}
+		return protocol.EncodeAck(protocol.Ack{Code: code}), nil
+	}
+	log.Infof("action: consulta_ganadores | result: success | agencia: %v | cant_ganadores: %v | desde: %v", agency, len(winners), query.Offset)
+	return page, nil
+}
+
+// decodeErrorCode Maps the error of decoding bets to the ack code sent
+func decodeErrorCode(err error) protocol.AckCode {
+	if errors.Is(err, protocol.ErrMalformedPayload) {
+		return protocol.AckMalformedMessage
+	}
+	return protocol.AckInvalidBet
+}
+
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return conn.RemoteAddr().String()
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/goserver/storage"
+)
+
+// Kinds of the events stored in the sessions journal
+const (
+	eventNonce = "nonce"
+	eventBatch = "batch"
+)
+
+// sessionsCompactEvery Amount of events appended to the sessions journal
+// after which it is compacted
+const sessionsCompactEvery = 1000
+
+// sessionEvent Record of the sessions journal. A nonce event carries the
+// greatest nonce accepted from an agency and a batch event the session and
+// sequence number of the last batch it committed
+type sessionEvent struct {
+	Kind     string `json:"event"`
+	Agency   int    `json:"agency"`
+	Nonce    uint64 `json:"nonce,omitempty"`
+	Session  uint64 `json:"session,omitempty"`
+	Sequence uint32 `json:"sequence,omitempty"`
+}
+
+// sessionKey Events of the same kind and agency supersede each other
+type sessionKey struct {
+	kind   string
+	agency int
+}
+
+// sessionJournal Journal of the session events. Since only the latest event
+// of each kind and agency matters, it keeps them in memory and compacts the
+// journal to them every sessionsCompactEvery appended events, so it does
+// not grow while the server runs. Safe to use from several goroutines
+type sessionJournal struct {
+	mu       sync.Mutex
+	journal  *storage.Journal
+	latest   map[sessionKey]sessionEvent
+	appended int
+}
+
+// openSessions Opens the sessions journal at path, restores the state it
+// stores and compacts it so that it keeps only the latest event of each
+// agency. The journal is then used to persist the changes of that state
+func openSessions(path string, nonces *nonceGuard, batches *batchSequencer) (*sessionJournal, error) {
+	sessions := &sessionJournal{latest: make(map[sessionKey]sessionEvent)}
+	journal, err := storage.OpenJournal(path, func(record json.RawMessage) error {
+		var event sessionEvent
+		if err := json.Unmarshal(record, &event); err != nil {
+			return err
+		}
+		switch event.Kind {
+		case eventNonce:
+			nonces.restore(event.Agency, event.Nonce)
+		case eventBatch:
+			batches.restore(event.Agency, event.Session, event.Sequence)
+		default:
+			return errors.Errorf("unknown session event %q", event.Kind)
+		}
+		sessions.latest[sessionKey{event.Kind, event.Agency}] = event
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sessions.journal = journal
+
+	if err := journal.Rewrite(sessions.snapshot()); err != nil {
+		journal.Close()
+		return nil, err
+	}
+	nonces.journal = sessions
+	log.Infof("action: restaurar_sesiones | result: success | nonces: %v | batches: %v", len(nonces.last), len(batches.agencies))
+	return sessions, nil
+}
+
+// Record Appends the session events with a single fsync. Implements
+// storage.Recorder, so the sequence of a batch is recorded together with
+// the rest of its group commit
+func (j *sessionJournal) Record(records []interface{}) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.journal.AppendAll(records); err != nil {
+		return errors.Wrap(errSessionState, err.Error())
+	}
+	for _, record := range records {
+		event := record.(sessionEvent)
+		j.latest[sessionKey{event.Kind, event.Agency}] = event
+	}
+
+	j.appended += len(records)
+	if j.appended >= sessionsCompactEvery {
+		j.appended = 0
+		// The events were already appended, so a failed compaction only
+		// delays it until the next one
+		if err := j.journal.Rewrite(j.snapshot()); err != nil {
+			log.Errorf("action: compactar_sesiones | result: fail | error: %v", err)
+		}
+	}
+	return nil
+}
+
+// snapshot Returns the latest event of each kind and agency, sorted so
+// the compacted journal does not depend on the map order. Must be called
+// with mu locked or before the journal is shared
+func (j *sessionJournal) snapshot() []interface{} {
+	events := make([]sessionEvent, 0, len(j.latest))
+	for _, event := range j.latest {
+		events = append(events, event)
+	}
+	sort.Slice(events, func(a, b int) bool {
+		if events[a].Kind != events[b].Kind {
+			return events[a].Kind > events[b].Kind
+		}
+		return events[a].Agency < events[b].Agency
+	})
+
+	records := make([]interface{}, len(events))
+	for i, event := range events {
+		records[i] = event
+	}
+	return records
+}
+
+// Close Closes the journal
+func (j *sessionJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.journal.Close()
+}
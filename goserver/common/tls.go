@@ -0,0 +1,69 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// agencyNamePrefix Prefix of the common name of agency certificates
+const agencyNamePrefix = "agency-"
+
+// ErrUnknownAgency Returned when a client certificate does not identify
+// an agency
+var ErrUnknownAgency = errors.New("certificate does not identify an agency")
+
+// TLSConfig Files of the certificate the server presents to its clients
+type TLSConfig struct {
+	Enabled  bool
+	CertFile string
+	KeyFile  string
+	// ClientCAFile PEM bundle of the authorities that sign the agency
+	// certificates. When set every client must present a certificate
+	// signed by one of them. See AgencyFromCertificate
+	ClientCAFile string
+}
+
+// LoadTLSConfig Builds the TLS configuration of the server. Returns nil if
+// TLS is not enabled
+func LoadTLSConfig(config TLSConfig) (*tls.Config, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load certificate %v", config.CertFile)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.ClientCAFile != "" {
+		data, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read client CA file %v", config.ClientCAFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates found in %v", config.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// AgencyFromCertificate Returns the agency identified by a client
+// certificate, whose subject common name must be agency-<id> or <id>
+func AgencyFromCertificate(certificate *x509.Certificate) (int, error) {
+	name := certificate.Subject.CommonName
+	agency, err := strconv.Atoi(strings.TrimPrefix(name, agencyNamePrefix))
+	if err != nil || agency <= 0 {
+		return 0, errors.Wrapf(ErrUnknownAgency, "common name %q", name)
+	}
+	return agency, nil
+}
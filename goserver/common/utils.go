@@ -0,0 +1,4 @@
+package common
+
+// LotteryWinnerNumber Simulated winner number in the lottery contest
+const LotteryWinnerNumber = 7574
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/viper"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/goserver/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/goserver/storage"
+)
+
+var log = logging.MustGetLogger("log")
+
+// InitConfig Function that uses viper library to parse configuration parameters.
+// Viper is configured to read variables from both environment variables and the
+// config file ./config.yaml. Environment variables takes precedence over parameters
+// defined in the configuration file. If some of the variables cannot be parsed,
+// an error is returned
+func InitConfig() (*viper.Viper, error) {
+	v := viper.New()
+
+	// Configure viper to read env variables with the SERVER_ prefix
+	v.AutomaticEnv()
+	v.SetEnvPrefix("server")
+	// Use a replacer to replace env variables underscores with points. This let us
+	// use nested configurations in the config file and at the same time define
+	// env variables for the nested configurations
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+
+	// Add env variables supported
+	v.BindEnv("address")
+	v.BindEnv("storage", "path")
+	v.BindEnv("storage", "sync")
+	v.BindEnv("storage", "sync_interval")
+	v.BindEnv("storage", "group_max_delay")
+	v.BindEnv("storage", "group_max_size")
+	v.BindEnv("draw", "expected_agencies")
+	v.BindEnv("draw", "deadline")
+	v.BindEnv("draw", "quorum")
+	v.BindEnv("draw", "state_path")
+	v.BindEnv("draw", "seeded")
+	v.BindEnv("signing", "key_file")
+	v.BindEnv("tls", "enabled")
+	v.BindEnv("tls", "cert_file")
+	v.BindEnv("tls", "key_file")
+	v.BindEnv("tls", "client_ca_file")
+	v.BindEnv("auth", "secrets_file")
+	v.BindEnv("auth", "secrets")
+	v.BindEnv("sessions", "state_path")
+	v.BindEnv("sessions", "nonce_reserve")
+	v.BindEnv("protocol", "maxFrameSize")
+	v.BindEnv("log", "level")
+
+	// Try to read configuration from config file. If config file
+	// does not exists then ReadInConfig will fail but configuration
+	// can be loaded from the environment variables so we shouldn't
+	// return an error in that case
+	v.SetConfigFile("./config.yaml")
+	if err := v.ReadInConfig(); err != nil {
+		fmt.Printf("Configuration could not be read from config file. Using env variables instead")
+	}
+
+	return v, nil
+}
+
+// InitLogger Receives the log level to be set in go-logging as a string. This method
+// parses the string and set the level to the logger. If the level string is not
+// valid an error is returned
+func InitLogger(logLevel string) error {
+	baseBackend := logging.NewLogBackend(os.Stdout, "", 0)
+	format := logging.MustStringFormatter(
+		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
+	)
+	backendFormatter := logging.NewBackendFormatter(baseBackend, format)
+
+	backendLeveled := logging.AddModuleLevel(backendFormatter)
+	logLevelCode, err := logging.LogLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	backendLeveled.SetLevel(logLevelCode, "")
+
+	// Set the backends to be used.
+	logging.SetBackend(backendLeveled)
+	return nil
+}
+
+// PrintConfig Print all the configuration parameters of the program.
+// For debugging purposes only
+func PrintConfig(v *viper.Viper) {
+	log.Infof("action: config | result: success | address: %s | storage_path: %s | storage_sync: %s | expected_agencies: %v | draw_deadline: %v | draw_quorum: %v | log_level: %s",
+		v.GetString("address"),
+		v.GetString("storage.path"),
+		v.GetString("storage.sync"),
+		v.GetInt("draw.expected_agencies"),
+		v.GetDuration("draw.deadline"),
+		v.GetInt("draw.quorum"),
+		v.GetString("log.level"),
+	)
+}
+
+func main() {
+	v, err := InitConfig()
+	if err != nil {
+		log.Criticalf("%s", err)
+	}
+
+	if err := InitLogger(v.GetString("log.level")); err != nil {
+		log.Criticalf("%s", err)
+	}
+
+	// Print program config with debugging purposes
+	PrintConfig(v)
+
+	// Prize rules are a list of objects, so they can only be set in the
+	// config file
+	var prizes []common.PrizeConfig
+	if err := v.UnmarshalKey("draw.prizes", &prizes); err != nil {
+		log.Criticalf("action: config | result: fail | key: draw.prizes | error: %v", err)
+		os.Exit(1)
+	}
+
+	var signingKey ed25519.PrivateKey
+	if path := v.GetString("signing.key_file"); path != "" {
+		if signingKey, err = protocol.LoadSigningKey(path); err != nil {
+			log.Criticalf("action: config | result: fail | key: signing.key_file | error: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	tlsConfig, err := common.LoadTLSConfig(common.TLSConfig{
+		Enabled:      v.GetBool("tls.enabled"),
+		CertFile:     v.GetString("tls.cert_file"),
+		KeyFile:      v.GetString("tls.key_file"),
+		ClientCAFile: v.GetString("tls.client_ca_file"),
+	})
+	if err != nil {
+		log.Criticalf("action: config | result: fail | key: tls | error: %v", err)
+		os.Exit(1)
+	}
+
+	secrets, err := common.LoadSecrets(v.GetString("auth.secrets_file"), v.GetString("auth.secrets"))
+	if err != nil {
+		log.Criticalf("action: config | result: fail | key: auth | error: %v", err)
+		os.Exit(1)
+	}
+
+	serverConfig := common.ServerConfig{
+		Address:      v.GetString("address"),
+		MaxFrameSize: v.GetInt("protocol.maxFrameSize"),
+		Storage: storage.Config{
+			Path:          v.GetString("storage.path"),
+			Sync:          storage.SyncPolicy(v.GetString("storage.sync")),
+			SyncInterval:  v.GetDuration("storage.sync_interval"),
+			GroupMaxDelay: v.GetDuration("storage.group_max_delay"),
+			GroupMaxSize:  v.GetInt("storage.group_max_size"),
+		},
+		Draw: common.DrawConfig{
+			ExpectedAgencies: v.GetInt("draw.expected_agencies"),
+			Deadline:         v.GetDuration("draw.deadline"),
+			Quorum:           v.GetInt("draw.quorum"),
+			StatePath:        v.GetString("draw.state_path"),
+			Prizes:           prizes,
+			Seeded:           v.GetBool("draw.seeded"),
+		},
+		SigningKey:   signingKey,
+		TLS:          tlsConfig,
+		AuthSecrets:  secrets,
+		SessionsPath: v.GetString("sessions.state_path"),
+		NonceReserve: v.GetDuration("sessions.nonce_reserve"),
+	}
+
+	server, err := common.NewServer(serverConfig)
+	if err != nil {
+		log.Criticalf("action: init_server | result: fail | address: %v | error: %v", serverConfig.Address, err)
+		os.Exit(1)
+	}
+
+	// SIGTERM and SIGINT stop accepting connections and close the open ones
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	if err := server.Run(ctx); err != nil {
+		os.Exit(1)
+	}
+	log.Infof("action: shutdown | result: success")
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Journal Append-only file of JSON records, one per line. Every record is
+// fsynced before Append returns, so a record that was appended survives a
+// crash of the process. A record torn by a crash while it was being written
+// is discarded when the journal is opened. A record whose append failed is
+// removed from the file, so it is never replayed
+type Journal struct {
+	mu   sync.Mutex
+	file *os.File
+	// err Error that left the journal unusable, set when a failed append
+	// could not be removed from the file
+	err error
+}
+
+// OpenJournal Opens or creates the journal at path and calls fn with every
+// complete record already stored in it, in the order they were appended
+func OpenJournal(path string, fn func(record json.RawMessage) error) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open journal %v", path)
+	}
+	if err := replay(file, fn); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "replay journal %v", path)
+	}
+	return &Journal{file: file}, nil
+}
+
+// replay Calls fn with every complete line of the file and truncates the
+// trailing incomplete line, if any, leaving the offset at the end of file
+func replay(file *os.File, fn func(record json.RawMessage) error) error {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	for _, line := range bytes.Split(data[:complete], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			return errors.Errorf("corrupt record %q", line)
+		}
+		if err := fn(json.RawMessage(line)); err != nil {
+			return err
+		}
+	}
+
+	if complete < len(data) {
+		log.Warningf("action: journal_replay | result: in_progress | file: %v | discarded_bytes: %v", file.Name(), len(data)-complete)
+		if err := file.Truncate(int64(complete)); err != nil {
+			return err
+		}
+	}
+	_, err = file.Seek(int64(complete), io.SeekStart)
+	return err
+}
+
+// Append Stores the JSON encoding of record and fsyncs the journal. If
+// the record cannot be written or synced, it is removed from the file
+// before returning the error, since the caller discards it as well. If it
+// cannot be removed, every later append fails
+func (j *Journal) Append(record interface{}) error {
+	return j.AppendAll([]interface{}{record})
+}
+
+// AppendAll Stores the JSON encoding of every record with a single write
+// and a single fsync. Either every record is appended or, as with Append,
+// none of them is
+func (j *Journal) AppendAll(records []interface{}) error {
+	var lines []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.err != nil {
+		return j.err
+	}
+	offset, err := j.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrapf(err, "append to journal %v", j.file.Name())
+	}
+
+	_, err = j.file.Write(lines)
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		if rollbackErr := j.rollback(offset); rollbackErr != nil {
+			j.err = errors.Wrapf(rollbackErr, "journal %v unusable after a failed append", j.file.Name())
+			log.Errorf("action: journal_append | result: fail | file: %v | error: %v", j.file.Name(), j.err)
+		}
+		return errors.Wrapf(err, "append to journal %v", j.file.Name())
+	}
+	return nil
+}
+
+// rollback Truncates the journal back to offset, removing a record that
+// was partially or fully written, and continues appending from there
+func (j *Journal) rollback(offset int64) error {
+	if err := j.file.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := j.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Rewrite Replaces every record of the journal with records, so a journal
+// whose older records are superseded by newer ones does not grow forever.
+// The new content is written to a temporary file that replaces the journal
+// atomically
+func (j *Journal) Rewrite(records []interface{}) error {
+	var content []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		content = append(append(content, line...), '\n')
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.err != nil {
+		return j.err
+	}
+	path := j.file.Name()
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return errors.Wrapf(err, "rewrite journal %v", path)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "rewrite journal %v", path)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "rewrite journal %v", path)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "rewrite journal %v", path)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrapf(err, "rewrite journal %v", path)
+	}
+
+	// From now on the old file is no longer the journal
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekEnd)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		j.err = errors.Wrapf(err, "journal %v unusable after a rewrite", path)
+		return j.err
+	}
+	j.file.Close()
+	j.file = file
+	return nil
+}
+
+// syncDir Flushes a directory so a rename inside it survives a crash
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Close Closes the journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// journalRecord Record appended to the journals of the tests
+type journalRecord struct {
+	N int `json:"n"`
+}
+
+// readJournal Opens the journal at path and returns it with the records
+// replayed from it
+func readJournal(t *testing.T, path string) (*Journal, []int) {
+	var records []int
+	journal, err := OpenJournal(path, func(raw json.RawMessage) error {
+		var record journalRecord
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return err
+		}
+		records = append(records, record.N)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return journal, records
+}
+
+func TestJournalDiscardsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	if err := os.WriteFile(path, []byte("{\"n\":1}\n{\"n\":2}\n{\"n\":"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, records := readJournal(t, path)
+	if want := []int{1, 2}; !reflect.DeepEqual(records, want) {
+		t.Errorf("replayed %v, want %v", records, want)
+	}
+	if err := journal.Append(journalRecord{3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The torn record was truncated, so the next one is not glued to it
+	journal, records = readJournal(t, path)
+	defer journal.Close()
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(records, want) {
+		t.Errorf("replayed %v after an append, want %v", records, want)
+	}
+}
+
+func TestJournalRejectsCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	if err := os.WriteFile(path, []byte("{\"n\":1}\nnot json\n{\"n\":2}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if journal, err := OpenJournal(path, func(json.RawMessage) error { return nil }); err == nil {
+		journal.Close()
+		t.Error("OpenJournal of a journal with a corrupt complete record succeeded")
+	}
+}
+
+func TestJournalFailedAppendIsRolledBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	journal, _ := readJournal(t, path)
+	if err := journal.Append(journalRecord{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only part of the records fits
+	restore := limitFileSize(t, 12)
+	err := journal.AppendAll([]interface{}{journalRecord{2}, journalRecord{3}})
+	restore()
+	if err == nil {
+		t.Fatal("AppendAll beyond the file size limit succeeded")
+	}
+
+	if err := journal.Append(journalRecord{4}); err != nil {
+		t.Fatalf("Append after a rolled back append: %v", err)
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	journal, records := readJournal(t, path)
+	defer journal.Close()
+	if want := []int{1, 4}; !reflect.DeepEqual(records, want) {
+		t.Errorf("replayed %v, want %v", records, want)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"syscall"
+	"testing"
+)
+
+// limitFileSize Makes writes beyond size bytes of any file fail with EFBIG
+// until the returned function restores the previous limit
+func limitFileSize(t *testing.T, size uint64) func() {
+	var previous syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &previous); err != nil {
+		t.Fatal(err)
+	}
+	limit := previous
+	limit.Cur = size
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Skipf("file size limit not available: %v", err)
+	}
+	return func() {
+		if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &previous); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package storage
+
+import "os"
+
+// lockFile Advisory locks are not supported on windows, where the store
+// only serializes the writers of its own process
+func lockFile(file *os.File, exclusive bool) error {
+	return nil
+}
+
+// unlockFile Releases the lock taken by lockFile
+func unlockFile(file *os.File) error {
+	return nil
+}
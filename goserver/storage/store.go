@@ -0,0 +1,407 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+)
+
+var log = logging.MustGetLogger("log")
+
+// recordFields Columns of every stored bet: agency, first_name, last_name,
+// document, birthdate and number
+const recordFields = 6
+
+// SyncPolicy Decides when appended bets are flushed to disk with fsync
+type SyncPolicy string
+
+const (
+	// SyncAlways Every append is fsynced before returning
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval Appends are fsynced in the background every SyncInterval
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever Flushing is left to the operating system
+	SyncNever SyncPolicy = "never"
+	// SyncGroup Concurrent appends are coalesced and written and fsynced
+	// together. Every append returns once its group is durable
+	SyncGroup SyncPolicy = "group"
+)
+
+// Config Configuration of a Store
+type Config struct {
+	Path         string
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	// GroupMaxDelay Maximum time the first append of a group waits for
+	// other appends to join it before the group is committed
+	GroupMaxDelay time.Duration
+	// GroupMaxSize Maximum amount of appends committed in a single group
+	GroupMaxSize int
+	// Recorder Persists the records passed to Append once their bets are
+	// written and, if the sync policy requires it, synced. With SyncGroup
+	// the records of a whole group are passed in a single call. Nil
+	// discards the records
+	Recorder Recorder
+}
+
+// Recorder Persists the records that accompany appended bets, such as the
+// sequence number of the batch they arrived in
+type Recorder interface {
+	Record(records []interface{}) error
+}
+
+// appendRequest Append waiting to be committed in a group
+type appendRequest struct {
+	data    []byte
+	records []interface{}
+	done    chan error
+}
+
+// Store Append-only bets storage. The file has the same CSV layout the
+// python server writes with csv.QUOTE_MINIMAL, so both can read what the
+// other wrote. Writers of the same process are serialized with a mutex and
+// every operation holds an advisory lock on the file, exclusive for appends
+// and shared for reads, so other processes honoring it can share the file
+type Store struct {
+	// pending Amount of Append calls waiting for their group to be durable.
+	// First field to keep it 64-bit aligned for atomic operations
+	pending int64
+
+	config Config
+
+	// mu Serializes appends and syncs of file and protects dirty and err
+	mu    sync.Mutex
+	file  *os.File
+	dirty bool
+	// err Error that left the store unusable, set when a failed append
+	// could not be removed from the file
+	err error
+
+	// requests Appends waiting for the group committer
+	requests chan appendRequest
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open Opens the storage file, creating it if needed. An empty sync policy
+// means SyncAlways. With SyncInterval and SyncGroup a background goroutine
+// is started, which is stopped by Close
+func Open(config Config) (*Store, error) {
+	switch config.Sync {
+	case "":
+		config.Sync = SyncAlways
+	case SyncAlways, SyncInterval, SyncNever:
+	case SyncGroup:
+		if config.GroupMaxSize <= 0 || config.GroupMaxDelay < 0 {
+			return nil, errors.Errorf("invalid group commit size %v or delay %v", config.GroupMaxSize, config.GroupMaxDelay)
+		}
+	default:
+		return nil, errors.Errorf("unknown sync policy %q", config.Sync)
+	}
+
+	file, err := os.OpenFile(config.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		config:   config,
+		file:     file,
+		requests: make(chan appendRequest),
+		stop:     make(chan struct{}),
+	}
+	if config.Sync == SyncInterval {
+		if config.SyncInterval <= 0 {
+			file.Close()
+			return nil, errors.Errorf("invalid sync interval %v", config.SyncInterval)
+		}
+		s.wg.Add(1)
+		go s.syncLoop()
+	}
+	if config.Sync == SyncGroup {
+		s.wg.Add(1)
+		go s.groupCommitLoop()
+	}
+	return s, nil
+}
+
+// Append Stores the bets at the end of the file with a single write and
+// then passes records, if any, to the Recorder. Depending on the sync
+// policy, the bets are durable when it returns. If only the records could
+// not be persisted, the error of the Recorder is returned. Must not be
+// called after Close
+func (s *Store) Append(bets []lottery.Bet, records ...interface{}) error {
+	var buf bytes.Buffer
+	for _, bet := range bets {
+		writeRecord(&buf, betRecord(bet))
+	}
+
+	if s.config.Sync == SyncGroup {
+		atomic.AddInt64(&s.pending, 1)
+		defer atomic.AddInt64(&s.pending, -1)
+		request := appendRequest{data: buf.Bytes(), records: records, done: make(chan error, 1)}
+		s.requests <- request
+		return <-request.done
+	}
+
+	s.mu.Lock()
+	err := s.write(buf.Bytes(), s.config.Sync == SyncAlways)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.record(records)
+}
+
+// record Passes the records to the Recorder, if there are both
+func (s *Store) record(records []interface{}) error {
+	if len(records) == 0 || s.config.Recorder == nil {
+		return nil
+	}
+	return s.config.Recorder.Record(records)
+}
+
+// write Appends data to the file under the exclusive file lock and fsyncs
+// it if requested. If data cannot be written or synced, the file is
+// truncated back to its previous size, so a half written row never reaches
+// the readers. If it cannot be truncated, every later append fails. Must be
+// called with mu locked
+func (s *Store) write(data []byte, sync bool) error {
+	if s.err != nil {
+		return s.err
+	}
+	if err := lockFile(s.file, true); err != nil {
+		return err
+	}
+	defer unlockFile(s.file)
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(data)
+	if err == nil {
+		s.dirty = true
+		if sync {
+			err = s.sync()
+		}
+	}
+	if err != nil {
+		if rollbackErr := s.rollback(info.Size()); rollbackErr != nil {
+			s.err = errors.Wrapf(rollbackErr, "storage %v unusable after a failed append", s.config.Path)
+			log.Errorf("action: store_bets | result: fail | file: %v | error: %v", s.config.Path, s.err)
+		}
+		return err
+	}
+	return nil
+}
+
+// rollback Truncates the file back to size, removing the bets of a failed
+// append. Appends continue at the new end of the file
+func (s *Store) rollback(size int64) error {
+	if err := s.file.Truncate(size); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Load Reads every stored bet in order and calls fn with each one. The
+// file is streamed, so bets are never fully loaded in memory. An error
+// returned by fn stops the iteration and is returned
+func (s *Store) Load(fn func(lottery.Bet) error) error {
+	file, err := os.Open(s.config.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := lockFile(file, false); err != nil {
+		return err
+	}
+	defer unlockFile(file)
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = recordFields
+	reader.ReuseRecord = true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Rows written by the python server may lack names or document
+		bet, err := lottery.ParseBet(record[0], record[1], record[2], record[3], record[4], record[5])
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return errors.Wrapf(err, "%s:%d", s.config.Path, line)
+		}
+		if err := fn(bet); err != nil {
+			return err
+		}
+	}
+}
+
+// Close Stops the background sync, if any, flushes pending appends and
+// closes the file
+func (s *Store) Close() error {
+	close(s.stop)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.config.Sync != SyncNever {
+		if err := s.sync(); err != nil {
+			s.file.Close()
+			return err
+		}
+	}
+	return s.file.Close()
+}
+
+// sync Flushes the file if something was appended since the last flush.
+// Must be called with mu locked
+func (s *Store) sync() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// groupCommitLoop Commits appends in groups. A group starts with the first
+// pending append and is committed when GroupMaxSize appends joined it,
+// GroupMaxDelay elapsed or every pending append already joined it, whatever
+// happens first. Every group is written with a single write and made
+// durable with a single fsync
+func (s *Store) groupCommitLoop() {
+	defer s.wg.Done()
+	for {
+		var group []appendRequest
+		select {
+		case <-s.stop:
+			return
+		case request := <-s.requests:
+			group = append(group, request)
+		}
+
+		timer := time.NewTimer(s.config.GroupMaxDelay)
+	collect:
+		for len(group) < s.config.GroupMaxSize && int64(len(group)) < atomic.LoadInt64(&s.pending) {
+			select {
+			case request := <-s.requests:
+				group = append(group, request)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		s.commit(group)
+	}
+}
+
+// commit Writes and fsyncs a group of appends, then records the records
+// of all of them together and reports the result to each one of them
+func (s *Store) commit(group []appendRequest) {
+	size := 0
+	var records []interface{}
+	for _, request := range group {
+		size += len(request.data)
+		records = append(records, request.records...)
+	}
+	data := make([]byte, 0, size)
+	for _, request := range group {
+		data = append(data, request.data...)
+	}
+
+	s.mu.Lock()
+	err := s.write(data, true)
+	s.mu.Unlock()
+
+	var recordErr error
+	if err == nil {
+		recordErr = s.record(records)
+	}
+	for _, request := range group {
+		if err == nil && len(request.records) > 0 {
+			request.done <- recordErr
+			continue
+		}
+		request.done <- err
+	}
+}
+
+func (s *Store) syncLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.config.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			err := s.sync()
+			s.mu.Unlock()
+			if err != nil {
+				log.Errorf("action: sync_bets | result: fail | error: %v", err)
+			}
+		}
+	}
+}
+
+func betRecord(bet lottery.Bet) []string {
+	return []string{
+		strconv.Itoa(bet.Agency),
+		bet.FirstName,
+		bet.LastName,
+		bet.Document,
+		bet.BirthdateString(),
+		strconv.Itoa(bet.Number),
+	}
+}
+
+// writeRecord Writes the fields the way python's csv.writer does with
+// csv.QUOTE_MINIMAL and its default dialect: fields are quoted only if they
+// contain the delimiter, the quote char or a line break, quotes are doubled
+// and rows end with \r\n. encoding/csv also quotes fields starting with a
+// space, which python would not, so it is not used for writing
+func writeRecord(buf *bytes.Buffer, fields []string) {
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if !strings.ContainsAny(field, ",\"\r\n") {
+			buf.WriteString(field)
+			continue
+		}
+		buf.WriteByte('"')
+		buf.WriteString(strings.ReplaceAll(field, `"`, `""`))
+		buf.WriteByte('"')
+	}
+	buf.WriteString("\r\n")
+}
@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+)
+
+// datasetPath Agency datasets shipped with the repository
+const datasetPath = "zip:../../.data/dataset.zip"
+
+// loadAgencyBatches Splits the dataset of every agency in batches the same
+// way the client does
+func loadAgencyBatches(b *testing.B) [][][]lottery.Bet {
+	b.Helper()
+	var agencies [][][]lottery.Bet
+	for agency := 1; agency <= 5; agency++ {
+		dataset, err := common.OpenDataset(datasetPath, agency)
+		if os.IsNotExist(err) {
+			b.Skipf("dataset not available: %v", err)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		var batches [][]lottery.Bet
+		builder := common.NewBatchBuilder(dataset, 100, common.DefaultBatchMaxBytes)
+		for {
+			batch, err := builder.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			batches = append(batches, batch.Bets)
+		}
+		dataset.Close()
+		agencies = append(agencies, batches)
+	}
+	return agencies
+}
+
+// benchmarkAppend Stores the five agency datasets with one goroutine per
+// agency appending its batches concurrently, as the server does
+func benchmarkAppend(b *testing.B, config Config) {
+	agencies := loadAgencyBatches(b)
+	dir := b.TempDir()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		config.Path = filepath.Join(dir, "bets.csv")
+		store, err := Open(config)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for _, batches := range agencies {
+			wg.Add(1)
+			go func(batches [][]lottery.Bet) {
+				defer wg.Done()
+				for _, batch := range batches {
+					if err := store.Append(batch); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}(batches)
+		}
+		wg.Wait()
+
+		if err := store.Close(); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		os.Remove(config.Path)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkAppendSyncPerBatch(b *testing.B) {
+	benchmarkAppend(b, Config{Sync: SyncAlways})
+}
+
+func BenchmarkAppendGroupCommit(b *testing.B) {
+	benchmarkAppend(b, Config{Sync: SyncGroup, GroupMaxDelay: 2 * time.Millisecond, GroupMaxSize: 64})
+}
+
+// TestWriteRecordMatchesPython Pins the rows written by writeRecord to the
+// bytes python's csv.writer produces with csv.QUOTE_MINIMAL for the same
+// fields, so both servers can share the bets file
+func TestWriteRecordMatchesPython(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+		want   string
+	}{
+		{"plain", []string{"1", "Juan", "Perez", "30904465", "1999-03-17", "7574"}, "1,Juan,Perez,30904465,1999-03-17,7574\r\n"},
+		{"comma and quote", []string{"2", "Pérez, Juan", `O"Brien`, "1", "2000-01-01", "1"}, "2,\"Pérez, Juan\",\"O\"\"Brien\",1,2000-01-01,1\r\n"},
+		{"spaces and line breaks", []string{"3", " leading", "trailing ", "a\nb", "c\rd", ""}, "3, leading,trailing ,\"a\nb\",\"c\rd\",\r\n"},
+		{"only quotes", []string{"4", `"`, `""`, `x,"y"`, "  ", "7"}, "4,\"\"\"\",\"\"\"\"\"\",\"x,\"\"y\"\"\",  ,7\r\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeRecord(&buf, test.fields)
+			if got := buf.String(); got != test.want {
+				t.Errorf("writeRecord(%q) = %q, want %q", test.fields, got, test.want)
+			}
+		})
+	}
+}
+
+// TestLoadAcceptsRowsOfPython Loads the rows python's store_bets writes
+// for bets without names or document, which its Bet class accepts
+func TestLoadAcceptsRowsOfPython(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	rows := "1,,Lorca,,1999-03-17,7574\r\n2,Juan,,30904465,2000-01-01,1\r\n"
+	if err := os.WriteFile(path, []byte(rows), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := Open(Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var bets []lottery.Bet
+	if err := store.Load(func(bet lottery.Bet) error {
+		bets = append(bets, bet)
+		return nil
+	}); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(bets) != 2 || bets[0].Number != 7574 || bets[1].Document != "30904465" {
+		t.Errorf("Load = %+v, want the two rows", bets)
+	}
+}
+
+// countingRecorder Records every record it receives and the amount of
+// calls it received them in
+type countingRecorder struct {
+	mu      sync.Mutex
+	calls   int
+	records []interface{}
+}
+
+func (r *countingRecorder) Record(records []interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	r.records = append(r.records, records...)
+	return nil
+}
+
+func TestGroupCommitRecordsTogether(t *testing.T) {
+	var recorder countingRecorder
+	store, err := Open(Config{
+		Path:          filepath.Join(t.TempDir(), "bets.csv"),
+		Sync:          SyncGroup,
+		GroupMaxDelay: 50 * time.Millisecond,
+		GroupMaxSize:  64,
+		Recorder:      &recorder,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	const appends = 32
+	bet := lottery.Bet{Agency: 1, FirstName: "A", LastName: "B", Document: "1", Number: 7574}
+	var wg sync.WaitGroup
+	for i := 0; i < appends; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := store.Append([]lottery.Bet{bet}, i); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(recorder.records) != appends {
+		t.Errorf("%d records recorded, want %d", len(recorder.records), appends)
+	}
+	if recorder.calls >= appends {
+		t.Errorf("records of %d appends recorded in %d calls", appends, recorder.calls)
+	}
+}
+
+func TestFailedAppendIsRolledBack(t *testing.T) {
+	for _, sync := range []SyncPolicy{SyncAlways, SyncNever} {
+		t.Run(string(sync), func(t *testing.T) {
+			store, err := Open(Config{Path: filepath.Join(t.TempDir(), "bets.csv"), Sync: sync})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			bet := lottery.Bet{Agency: 1, FirstName: "Santiago Lionel", LastName: "Lorca", Document: "30904465", Birthdate: time.Date(1999, time.March, 17, 0, 0, 0, 0, time.UTC), Number: 7574}
+			if err := store.Append([]lottery.Bet{bet}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Only part of the first row of the batch fits
+			restore := limitFileSize(t, 60)
+			err = store.Append([]lottery.Bet{bet, bet, bet})
+			restore()
+			if err == nil {
+				t.Fatal("Append beyond the file size limit succeeded")
+			}
+
+			if err := store.Append([]lottery.Bet{bet}); err != nil {
+				t.Fatalf("Append after a rolled back append: %v", err)
+			}
+			var stored int
+			if err := store.Load(func(lottery.Bet) error {
+				stored++
+				return nil
+			}); err != nil {
+				t.Fatalf("Load after a rolled back append: %v", err)
+			}
+			if stored != 2 {
+				t.Errorf("%d bets stored, want 2", stored)
+			}
+		})
+	}
+}
@@ -1,5 +1,6 @@
 import csv
 import datetime
+import fcntl
 import time
 
 
@@ -30,10 +31,13 @@ def has_won(bet: Bet) -> bool:
 
 """
 Persist the information of each bet in the STORAGE_FILEPATH file.
-Not thread-safe/process-safe.
+Holds an exclusive flock on the file while writing, so other processes
+that honor it (such as goserver) never see partial rows.
+Not thread-safe.
 """
 def store_bets(bets: list[Bet]) -> None:
     with open(STORAGE_FILEPATH, 'a+') as file:
+        fcntl.flock(file, fcntl.LOCK_EX)
         writer = csv.writer(file, quoting=csv.QUOTE_MINIMAL)
         for bet in bets:
             writer.writerow([bet.agency, bet.first_name, bet.last_name,
@@ -41,10 +45,12 @@ def store_bets(bets: list[Bet]) -> None:
 
 """
 Loads the information all the bets in the STORAGE_FILEPATH file.
-Not thread-safe/process-safe.
+Holds a shared flock on the file while reading.
+Not thread-safe.
 """
 def load_bets() -> list[Bet]:
     with open(STORAGE_FILEPATH, 'r') as file:
+        fcntl.flock(file, fcntl.LOCK_SH)
         reader = csv.reader(file, quoting=csv.QUOTE_MINIMAL)
         for row in reader:
             yield Bet(row[0], row[1], row[2], row[3], row[4], row[5])